@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"log"
+	"m8client/input"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultPressDuration is how long press holds keys for when it isn't told.
+const defaultPressDuration = 50 * time.Millisecond
+
+// automationCommand is a command from a script, one JSON object per line:
+//
+//	{"cmd": "press", "keys": "select+edit", "duration": "50ms"}
+//	{"cmd": "hold", "keys": "down"}
+//	{"cmd": "release", "keys": "down"}
+//	{"cmd": "sequence", "steps": ["0s down", "30ms none", "100ms edit", "30ms none"]}
+//	{"cmd": "screenshot", "path": "/tmp/m8.png"}
+//	{"cmd": "read_text", "cells": true}
+//
+// Keys are written as input.ParseKeys takes them, and sequence steps as lines of a macro file. Presses and sequences
+// happen on top of the keys held with hold, and everything scripts hold is combined with what's held on the keyboard
+// or GPIO.
+type automationCommand struct {
+	Cmd      string   `json:"cmd"`
+	Keys     string   `json:"keys,omitempty"`
+	Duration string   `json:"duration,omitempty"`
+	Steps    []string `json:"steps,omitempty"`
+	Path     string   `json:"path,omitempty"`
+
+	// Cells asks read_text for the colors of every cell as well as the text.
+	Cells bool `json:"cells,omitempty"`
+}
+
+// automationResponse is the reply to every command, one JSON object per line.
+type automationResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	// PNG is a screenshot, if one was asked for without a path to save it to.
+	PNG []byte `json:"png,omitempty"`
+
+	// Text is what's on the screen, for read_text.
+	Text *automationText `json:"text,omitempty"`
+
+	// frame is a screenshot to be encoded off the main thread.
+	frame *image.RGBA
+}
+
+// automationText is the text on the m8's screen.
+type automationText struct {
+	// Title is the first line of text, which is the name of the view the m8's showing.
+	Title string   `json:"title"`
+	Lines []string `json:"lines"`
+
+	// Cursor is the cell the m8's cursor is in, if it can be found.
+	Cursor *automationCell `json:"cursor,omitempty"`
+
+	// Cells is every cell, row by row, if they were asked for.
+	Cells [][]automationCell `json:"cells,omitempty"`
+}
+
+// automationCell is a cell of text on the m8's screen.
+type automationCell struct {
+	Row    int    `json:"row"`
+	Column int    `json:"column"`
+	Ch     string `json:"ch,omitempty"`
+	Fg     color  `json:"fg"`
+	Bg     color  `json:"bg"`
+}
+
+// automationRequest is a command waiting to be handled on the main thread.
+type automationRequest struct {
+	command automationCommand
+	reply   chan<- automationResponse
+}
+
+// automationServer accepts commands from scripts on a local socket and hands them to the main loop.
+type automationServer struct {
+	logger   *log.Logger
+	listener net.Listener
+
+	requests chan automationRequest
+}
+
+// newAutomationServer listens on addr: a Unix socket path, or tcp:HOST:PORT for TCP, which is only allowed on
+// localhost since anything that can connect can press the m8's keys.
+func newAutomationServer(logger *log.Logger, addr string) (*automationServer, error) {
+	var (
+		listener net.Listener
+		err      error
+	)
+
+	if tcpAddr, ok := strings.CutPrefix(addr, "tcp:"); ok {
+		host, _, splitErr := net.SplitHostPort(tcpAddr)
+		if splitErr != nil {
+			return nil, errors.Wrapf(splitErr, "invalid automation address %s", addr)
+		}
+
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, errors.Errorf("automation over TCP is only allowed on localhost, not %s", host)
+		}
+
+		listener, err = net.Listen("tcp", tcpAddr)
+	} else {
+		// A socket left behind by a client that didn't shut down cleanly would stop us listening.
+		if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+
+		listener, err = net.Listen("unix", addr)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error listening for automation")
+	}
+
+	s := automationServer{
+		logger:   logger,
+		listener: listener,
+		requests: make(chan automationRequest),
+	}
+
+	go s.run()
+
+	return &s, nil
+}
+
+func (s *automationServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *automationServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *automationServer) run() {
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			s.logger.Printf("error accepting automation connection: %s\n", err)
+			continue
+		}
+
+		go s.serve(conn)
+	}
+}
+
+// serve handles one script's commands in turn until it disconnects.
+func (s *automationServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		scanner = bufio.NewScanner(conn)
+		encoder = json.NewEncoder(conn)
+		reply   = make(chan automationResponse, 1)
+	)
+
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var (
+			command  automationCommand
+			response automationResponse
+		)
+
+		if err := json.Unmarshal(scanner.Bytes(), &command); err != nil {
+			response.Error = errors.Wrap(err, "invalid command").Error()
+		} else {
+			s.requests <- automationRequest{command, reply}
+			response = <-reply
+		}
+
+		if response.frame != nil {
+			response.finishScreenshot(command.Path)
+		}
+
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+// finishScreenshot encodes the frame, saving it to path if there is one or including it in the response if not.
+func (r *automationResponse) finishScreenshot(path string) {
+	frame := r.frame
+	r.frame = nil
+
+	if path != "" {
+		if err := writePNG(path, frame); err != nil {
+			r.OK, r.Error = false, err.Error()
+		}
+
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, frame); err != nil {
+		r.OK, r.Error = false, errors.Wrap(err, "error encoding screenshot").Error()
+		return
+	}
+
+	r.PNG = buf.Bytes()
+}
+
+// automationBusy returns whether a script's timed command is still playing, in which case the next one waits.
+func (c *controller) automationBusy() bool {
+	return c.scriptPlayer != nil
+}
+
+// automate handles a command from a script. Commands that take time reply once they're done.
+func (c *controller) automate(req automationRequest, now time.Time) {
+	response, err := c.runAutomationCommand(req.command, now)
+	if err != nil {
+		req.reply <- automationResponse{Error: err.Error()}
+		return
+	}
+
+	if c.scriptPlayer != nil {
+		c.scriptReply = req.reply
+		return
+	}
+
+	response.OK = true
+	req.reply <- response
+}
+
+func (c *controller) runAutomationCommand(command automationCommand, now time.Time) (automationResponse, error) {
+	var keys input.CmdKey
+	if command.Keys != "" {
+		var err error
+		if keys, err = input.ParseKeys(command.Keys); err != nil {
+			return automationResponse{}, err
+		}
+	}
+
+	switch command.Cmd {
+	case "press":
+		duration := defaultPressDuration
+		if command.Duration != "" {
+			var err error
+			if duration, err = time.ParseDuration(command.Duration); err != nil || duration < 0 {
+				return automationResponse{}, errors.Errorf("invalid duration %q", command.Duration)
+			}
+		}
+
+		return automationResponse{}, c.playScript(input.Macro{
+			{Delay: 0, Keys: c.scriptKeys | keys},
+			{Delay: duration, Keys: c.scriptKeys},
+		}, now)
+
+	case "hold":
+		c.scriptKeys |= keys
+		return automationResponse{}, c.sendHeldKeys()
+
+	case "release":
+		if command.Keys == "" {
+			keys = c.scriptKeys
+		}
+
+		c.scriptKeys &^= keys
+		return automationResponse{}, c.sendHeldKeys()
+
+	case "sequence":
+		macro, err := input.ReadMacro(strings.NewReader(strings.Join(command.Steps, "\n")))
+		if err != nil {
+			return automationResponse{}, errors.Wrap(err, "invalid steps")
+		}
+
+		for i := range macro {
+			macro[i].Keys |= c.scriptKeys
+		}
+
+		return automationResponse{}, c.playScript(macro, now)
+
+	case "screenshot":
+		frame, err := c.renderer.backend.snapshot()
+		if err != nil {
+			return automationResponse{}, errors.Wrap(err, "error taking screenshot")
+		}
+
+		return automationResponse{frame: frame}, nil
+
+	case "read_text":
+		return automationResponse{Text: c.readText(command.Cells)}, nil
+
+	default:
+		return automationResponse{}, errors.Errorf("unknown command %q", command.Cmd)
+	}
+}
+
+// playScript starts playing a script's timed keys, which are held along with the physical ones.
+func (c *controller) playScript(macro input.Macro, now time.Time) error {
+	c.scriptPlayer = input.NewMacroPlayer(macro, 1, now)
+	return c.stepScript(now)
+}
+
+// stepScript sends the playing script's key changes that are due at now, and replies once it's done.
+func (c *controller) stepScript(now time.Time) error {
+	if c.scriptPlayer == nil {
+		return nil
+	}
+
+	for {
+		keys, ok := c.scriptPlayer.Next(now)
+		if !ok {
+			break
+		}
+
+		c.scriptKeys = keys
+		if err := c.sendHeldKeys(); err != nil {
+			c.finishScript(err)
+			return err
+		}
+	}
+
+	if c.scriptPlayer.Done() {
+		c.finishScript(nil)
+	}
+
+	return nil
+}
+
+// finishScript stops the playing script and replies to the command that started it.
+func (c *controller) finishScript(err error) {
+	c.scriptPlayer = nil
+
+	if c.scriptReply == nil {
+		return
+	}
+
+	response := automationResponse{OK: err == nil}
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	c.scriptReply <- response
+	c.scriptReply = nil
+}
+
+// readText returns the text on the m8's screen, with every cell's colors if cells is set.
+func (c *controller) readText(cells bool) *automationText {
+	var (
+		grid = &c.renderer.text
+		text = automationText{Lines: grid.lines()}
+	)
+
+	for _, line := range text.Lines {
+		if title := strings.TrimSpace(line); title != "" {
+			text.Title = title
+			break
+		}
+	}
+
+	cellAt := func(column, row int) automationCell {
+		cell := grid.cells[row*grid.columns+column]
+
+		ac := automationCell{Row: row, Column: column, Fg: cell.fg, Bg: cell.bg}
+		if cell.ch != 0 {
+			ac.Ch = string(rune(cell.ch))
+		}
+
+		return ac
+	}
+
+	if column, row, ok := grid.cursor(c.renderer.bgColor); ok {
+		cursor := cellAt(column, row)
+		text.Cursor = &cursor
+	}
+
+	if cells {
+		text.Cells = make([][]automationCell, grid.rows)
+		for row := range text.Cells {
+			text.Cells[row] = make([]automationCell, grid.columns)
+			for column := range text.Cells[row] {
+				text.Cells[row][column] = cellAt(column, row)
+			}
+		}
+	}
+
+	return &text
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAutomation(t *testing.T) {
+	var (
+		device = &bytes.Buffer{}
+		ctrl   = controller{
+			logger:   log.New(io.Discard, "", 0),
+			renderer: newRenderer(newFramebufferRenderBackend()),
+			device:   device,
+		}
+	)
+
+	server, err := newAutomationServer(ctrl.logger, "tcp:127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Stand in for the main loop.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		tick := time.NewTicker(time.Millisecond)
+		defer tick.Stop()
+
+		for {
+			var requests <-chan automationRequest
+			if !ctrl.automationBusy() {
+				requests = server.requests
+			}
+
+			select {
+			case req := <-requests:
+				ctrl.automate(req, time.Now())
+			case now := <-tick.C:
+				if err := ctrl.stepScript(now); err != nil {
+					t.Error(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	responses := bufio.NewScanner(conn)
+	send := func(command string) automationResponse {
+		t.Helper()
+
+		if _, err := io.WriteString(conn, command+"\n"); err != nil {
+			t.Fatal(err)
+		}
+
+		if !responses.Scan() {
+			t.Fatalf("no response to %s: %v", command, responses.Err())
+		}
+
+		var response automationResponse
+		if err := json.Unmarshal(responses.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+
+		return response
+	}
+
+	for _, command := range []string{
+		`{"cmd": "hold", "keys": "down"}`,
+		`{"cmd": "press", "keys": "edit", "duration": "5ms"}`,
+		`{"cmd": "sequence", "steps": ["0s option", "5ms none"]}`,
+		`{"cmd": "release"}`,
+	} {
+		if response := send(command); !response.OK {
+			t.Fatalf("%s failed: %s", command, response.Error)
+		}
+	}
+
+	want := []byte{
+		'C', 0x20, // hold down
+		'C', 0x21, 'C', 0x20, // press edit
+		'C', 0x22, 'C', 0x20, // sequence
+		'C', 0x00, // release
+	}
+	if !bytes.Equal(device.Bytes(), want) {
+		t.Fatalf("sent % x; want % x", device.Bytes(), want)
+	}
+
+	response := send(`{"cmd": "screenshot"}`)
+	if !response.OK {
+		t.Fatalf("screenshot failed: %s", response.Error)
+	}
+
+	img, err := png.Decode(bytes.NewReader(response.PNG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != int(defaultScreenSize.width) || bounds.Dy() != int(defaultScreenSize.height) {
+		t.Fatalf("screenshot is %v", bounds)
+	}
+
+	if response := send(`{"cmd": "read_text", "cells": true}`); !response.OK || response.Text == nil || len(response.Text.Cells) != ctrl.renderer.text.rows {
+		t.Fatalf("read_text failed: %+v", response)
+	}
+
+	for _, command := range []string{`{"cmd": "press", "keys": "jump"}`, `{"cmd": "dance"}`, `not json`} {
+		if response := send(command); response.OK || response.Error == "" {
+			t.Errorf("expected %s to fail", command)
+		}
+	}
+
+	if _, err := newAutomationServer(ctrl.logger, "tcp:0.0.0.0:0"); err == nil {
+		t.Error("expected automation over TCP to be refused off localhost")
+	}
+}
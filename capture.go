@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A capture file records the raw serial traffic of a session so it can be replayed later.
+//
+// It starts with a header:
+//
+//	[5]byte magic ("M8CAP"), uint8 version, int64 session start (unix nanoseconds)
+//
+// followed by a record for every read from or write to the device:
+//
+//	uint8 direction ('R' or 'W'), int64 offset from session start (nanoseconds), uint32 length, [length]byte data
+//
+// All integers are little endian.
+const (
+	captureMagic   = "M8CAP"
+	captureVersion = 1
+
+	captureHeaderLen = len(captureMagic) + 1 + 8
+	captureRecordLen = 1 + 8 + 4
+)
+
+type captureDirection byte
+
+const (
+	// captureDirRead is data read from the m8.
+	captureDirRead captureDirection = 'R'
+
+	// captureDirWrite is data written to the m8.
+	captureDirWrite captureDirection = 'W'
+)
+
+// captureWriter writes a capture file.
+type captureWriter struct {
+	mu    sync.Mutex
+	file  *os.File
+	start time.Time
+	buf   []byte
+
+	// stopped is set once a record couldn't be written, after which nothing more is recorded.
+	stopped bool
+}
+
+func newCaptureWriter(path string) (*captureWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating capture file")
+	}
+
+	w := captureWriter{
+		file:  file,
+		start: time.Now(),
+	}
+
+	header := make([]byte, 0, captureHeaderLen)
+	header = append(header, captureMagic...)
+	header = append(header, captureVersion)
+	header = binary.LittleEndian.AppendUint64(header, uint64(w.start.UnixNano()))
+
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "error writing capture header")
+	}
+
+	return &w, nil
+}
+
+// write records data as having gone in the given direction just now.
+//
+// Records are written straight through to the file so a capture survives the client crashing. If one can't be, the
+// error's returned and recording stops, since the capture can't be replayed past the missing record anyway.
+func (w *captureWriter) write(dir captureDirection, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopped {
+		return nil
+	}
+
+	w.buf = append(w.buf[:0], byte(dir))
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, uint64(time.Since(w.start)))
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(len(data)))
+	w.buf = append(w.buf, data...)
+
+	if _, err := w.file.Write(w.buf); err != nil {
+		w.stopped = true
+		return errors.Wrap(err, "error writing capture record")
+	}
+
+	return nil
+}
+
+func (w *captureWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.file.Close()
+}
+
+// recordingDevice tees everything read from and written to device into a capture.
+//
+// Failing to record doesn't fail the read or write, since the session can carry on without it; the error's logged and
+// recording stops.
+type recordingDevice struct {
+	logger  *log.Logger
+	device  io.ReadWriter
+	capture *captureWriter
+}
+
+func (d recordingDevice) Read(buf []byte) (int, error) {
+	n, err := d.device.Read(buf)
+	if n > 0 {
+		d.record(captureDirRead, buf[:n])
+	}
+
+	return n, err
+}
+
+func (d recordingDevice) Write(buf []byte) (int, error) {
+	n, err := d.device.Write(buf)
+	if n > 0 {
+		d.record(captureDirWrite, buf[:n])
+	}
+
+	return n, err
+}
+
+func (d recordingDevice) record(dir captureDirection, data []byte) {
+	if err := d.capture.write(dir, data); err != nil {
+		d.logger.Printf("stopped recording session: %s\n", err)
+	}
+}
+
+type captureRecord struct {
+	dir    captureDirection
+	offset time.Duration
+	data   []byte
+}
+
+// captureReader reads a capture file written by captureWriter.
+type captureReader struct {
+	r     io.Reader
+	start time.Time
+	buf   []byte
+}
+
+func newCaptureReader(r io.Reader) (*captureReader, error) {
+	header := make([]byte, captureHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "error reading capture header")
+	}
+
+	if string(header[:len(captureMagic)]) != captureMagic {
+		return nil, errors.New("not a capture file")
+	}
+
+	if version := header[len(captureMagic)]; version != captureVersion {
+		return nil, errors.Errorf("unsupported capture version %d", version)
+	}
+
+	return &captureReader{
+		r:     r,
+		start: time.Unix(0, int64(binary.LittleEndian.Uint64(header[len(captureMagic)+1:]))),
+	}, nil
+}
+
+// next returns the next record in the capture, or io.EOF if there are none left.
+//
+// The record's data is only valid until the next call.
+func (r *captureReader) next() (captureRecord, error) {
+	var header [captureRecordLen]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.EOF {
+			return captureRecord{}, io.EOF
+		}
+
+		return captureRecord{}, errors.Wrap(err, "error reading capture record")
+	}
+
+	var (
+		dir    = captureDirection(header[0])
+		offset = time.Duration(binary.LittleEndian.Uint64(header[1:]))
+		n      = binary.LittleEndian.Uint32(header[9:])
+	)
+
+	if dir != captureDirRead && dir != captureDirWrite {
+		return captureRecord{}, errors.Errorf("unknown capture record direction 0x%x", byte(dir))
+	}
+
+	if cap(r.buf) < int(n) {
+		r.buf = make([]byte, n)
+	}
+	r.buf = r.buf[:n]
+
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		return captureRecord{}, errors.Wrap(err, "error reading capture record data")
+	}
+
+	return captureRecord{dir, offset, r.buf}, nil
+}
+
+// replayDevice stands in for the m8 by playing back what was read from it in a capture.
+//
+// Writes are swallowed. Once the capture runs out, Read returns io.EOF.
+type replayDevice struct {
+	capture *captureReader
+
+	// speed scales the capture's timing: 1 plays back in real time, 2 twice as fast and so on. 0 plays back as fast
+	// as possible.
+	speed float64
+
+	// started is when playback started and first is the offset of the first record played.
+	started time.Time
+	first   time.Duration
+
+	pending []byte
+}
+
+func newReplayDevice(r io.Reader, speed float64) (*replayDevice, error) {
+	if speed < 0 {
+		return nil, errors.Errorf("invalid replay speed %v", speed)
+	}
+
+	capture, err := newCaptureReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &replayDevice{capture: capture, speed: speed}, nil
+}
+
+func (d *replayDevice) Read(buf []byte) (int, error) {
+	for len(d.pending) == 0 {
+		record, err := d.capture.next()
+		if err != nil {
+			return 0, err
+		}
+
+		if record.dir != captureDirRead || len(record.data) == 0 {
+			continue
+		}
+
+		d.wait(record.offset)
+		d.pending = record.data
+	}
+
+	n := copy(buf, d.pending)
+	d.pending = d.pending[n:]
+
+	return n, nil
+}
+
+// wait sleeps until it's time to play back a record captured at offset.
+func (d *replayDevice) wait(offset time.Duration) {
+	if d.started.IsZero() {
+		d.started, d.first = time.Now(), offset
+		return
+	}
+
+	if d.speed == 0 {
+		return
+	}
+
+	due := d.started.Add(time.Duration(float64(offset-d.first) / d.speed))
+	time.Sleep(time.Until(due))
+}
+
+func (d *replayDevice) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
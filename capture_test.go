@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	var (
+		path    = filepath.Join(t.TempDir(), "session.m8cap")
+		traffic = testTraffic()
+	)
+
+	capture, err := newCaptureWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := recordingDevice{log.New(io.Discard, "", 0), &loopDevice{data: traffic, chunk: 512}, capture}
+	if _, err := rec.Write([]byte{'E', 'R'}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	for read := 0; read < len(traffic); {
+		n, err := rec.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		read += n
+	}
+
+	if err := capture.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	replay, err := newReplayDevice(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes go nowhere, and only what was read from the device is played back.
+	if n, err := replay.Write([]byte{'C', 0xff}); n != 2 || err != nil {
+		t.Fatalf("expected write to be swallowed; got %d, %v", n, err)
+	}
+
+	replayed, err := io.ReadAll(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(replayed, traffic) {
+		t.Fatalf("expected %d bytes of traffic to be replayed; got %d", len(traffic), len(replayed))
+	}
+}
+
+func TestCaptureWriteErrorStopsRecording(t *testing.T) {
+	capture, err := newCaptureWriter(filepath.Join(t.TempDir(), "session.m8cap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the file makes every record fail to write.
+	capture.file.Close()
+
+	var (
+		logs bytes.Buffer
+		rec  = recordingDevice{log.New(&logs, "", 0), &loopDevice{data: testTraffic(), chunk: 512}, capture}
+		buf  = make([]byte, 1024)
+	)
+
+	for i := 0; i < 3; i++ {
+		if n, err := rec.Read(buf); n == 0 || err != nil {
+			t.Fatalf("expected the read to carry on; got %d, %v", n, err)
+		}
+	}
+
+	if n, err := rec.Write([]byte{'E', 'R'}); n != 2 || err != nil {
+		t.Fatalf("expected the write to carry on; got %d, %v", n, err)
+	}
+
+	if got := strings.Count(logs.String(), "stopped recording"); got != 1 {
+		t.Fatalf("expected recording to stop once; got %q", logs.String())
+	}
+}
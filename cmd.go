@@ -2,9 +2,9 @@ package main
 
 import (
 	"fmt"
-	"math"
+	"strings"
 
-	"github.com/veandco/go-sdl2/sdl"
+	"github.com/pkg/errors"
 )
 
 type cmd interface {
@@ -23,7 +23,18 @@ type color struct {
 	r, g, b uint8
 }
 
+// parseColor parses a color written as RRGGBB hex, optionally prefixed with #.
+func parseColor(s string) (color, error) {
+	var c color
+	if _, err := fmt.Sscanf(strings.TrimPrefix(s, "#"), "%02x%02x%02x", &c.r, &c.g, &c.b); err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return color{}, errors.Errorf("invalid color %q (expected RRGGBB)", s)
+	}
+
+	return c, nil
+}
+
 const (
+	systemInfoOpCode               = 0xFF
 	drawRectOpCode                 = 0xFE
 	drawCharacteOpCode             = 0xFD
 	drawOscilloscopeWaveformOpCode = 0xFC
@@ -61,31 +72,17 @@ type DrawRectCmd struct {
 }
 
 func (c DrawRectCmd) execute(ctrlCtx *controllerContext) error {
-	var (
-		renderer    = ctrlCtx.renderer
-		sdlRenderer = ctrlCtx.renderer.renderer
-	)
-
-	if c.pos.x == 0 && c.pos.y == 0 && c.size.width == int16(m8ScreenWidth) && c.size.height == int16(m8ScreenHeight) {
-		renderer.bgColor = c.color
-	}
+	renderer := ctrlCtx.renderer
 
-	if err := sdlRenderer.SetDrawColor(c.color.r, c.color.g, c.color.b, 0xff); err != nil {
-		return err
-	}
-
-	renderRect := sdl.Rect{
-		X: int32(c.pos.x),
-		Y: int32(c.pos.y),
-		W: int32(c.size.width),
-		H: int32(c.size.height),
+	if c.pos == (position{0, 0}) && c.size == renderer.screen {
+		if err := renderer.setBackground(c.color); err != nil {
+			return err
+		}
 	}
 
-	if err := sdlRenderer.FillRect(&renderRect); err != nil {
-		return err
-	}
+	renderer.text.clearRect(c.pos, c.size)
 
-	return nil
+	return renderer.backend.fillRect(c.pos, c.size, renderer.themed(c.color))
 }
 
 type DrawCharCmd struct {
@@ -97,103 +94,131 @@ type DrawCharCmd struct {
 
 func (c DrawCharCmd) execute(ctrlCtx *controllerContext) error {
 	var (
-		renderer    = ctrlCtx.renderer
-		sdlRenderer = renderer.renderer
-		x           = int32(c.pos.x)
-		y           = int32(c.pos.y)
+		renderer = ctrlCtx.renderer
+		backend  = renderer.backend
+		font     = renderer.font
+		bg       = c.background
 	)
 
+	// Whether there's a background has to be decided from the m8's colors, since a theme can map different colors to
+	// the same one.
 	if c.background != c.foreground {
-		if err := sdlRenderer.SetDrawColor(c.background.r, c.background.g, c.background.b, math.MaxUint8); err != nil {
+		pos, size := font.background(c.pos)
+		if err := backend.fillRect(pos, size, renderer.themed(c.background)); err != nil {
 			return err
 		}
-
-		if err := sdlRenderer.FillRect(&sdl.Rect{
-			X: x - 1,
-			Y: y + 2,
-			W: fontChWidth - 1,
-			H: fontChHeight + 1,
-		}); err != nil {
-			return err
-		}
-	}
-
-	if err := ctrlCtx.renderer.font.SetColorMod(c.foreground.r, c.foreground.g, c.foreground.b); err != nil {
-		return err
+	} else {
+		// Characters drawn without a background show the screen's.
+		bg = renderer.bgColor
 	}
 
-	var (
-		row    = c.ch / fontChsPerRow
-		column = c.ch % fontChsPerRow
-
-		sourceRect = sdl.Rect{
-			X: int32(column * 8),
-			Y: int32(row * 8),
-			W: fontChWidth,
-			H: fontChHeight,
-		}
-
-		renderRect = sdl.Rect{
-			X: x,
-			Y: y + 3,
-			W: fontChWidth,
-			H: fontChHeight,
-		}
-	)
-
-	if err := sdlRenderer.Copy(renderer.font, &sourceRect, &renderRect); err != nil {
-		return err
-	}
+	renderer.text.drawChar(c.ch, c.pos, c.foreground, bg)
 
-	return nil
+	return backend.drawGlyph(font, c.ch, font.glyphPosition(c.pos), renderer.themed(c.foreground))
 }
 
 type DrawOscWaveformCmd struct {
-	color    color
+	color color
+
+	// waveform is kept in the storage of the batch it was decoded into, since the packet it came in is only valid until
+	// the next packets are decoded.
 	waveform []byte
 }
 
 func (c DrawOscWaveformCmd) execute(ctrlCtx *controllerContext) error {
 	var (
-		renderer    = ctrlCtx.renderer
-		sdlRenderer = renderer.renderer
+		renderer = ctrlCtx.renderer
+		screen   = renderer.screen
 	)
 
-	renderRect := sdl.Rect{
-		X: 0,
-		Y: 0,
-		W: m8ScreenWidth,
-		H: m8ScreenHeight / 8,
-	}
-
-	if err := sdlRenderer.SetDrawColor(renderer.bgColor.r, renderer.bgColor.g, renderer.bgColor.b, math.MaxUint8); err != nil {
+	if err := renderer.backend.fillRect(position{0, 0}, size{screen.width, screen.height / 8}, renderer.themed(renderer.bgColor)); err != nil {
 		return err
 	}
 
-	if err := sdlRenderer.FillRect(&renderRect); err != nil {
-		return err
+	if len(c.waveform) == 0 {
+		return nil
 	}
 
-	if err := sdlRenderer.DrawRect(&renderRect); err != nil {
-		return err
+	if cap(renderer.waveform) < len(c.waveform) {
+		renderer.waveform = make([]position, len(c.waveform))
 	}
 
-	if len(c.waveform) == 0 {
-		return nil
+	points := renderer.waveform[:len(c.waveform)]
+	for x, y := range c.waveform {
+		points[x] = position{int16(x), int16(y)}
 	}
 
-	if err := sdlRenderer.SetDrawColor(c.color.r, c.color.g, c.color.b, math.MaxUint8); err != nil {
-		return err
+	return renderer.backend.drawPoints(points, renderer.themed(c.color))
+}
+
+// hardwareModel is the kind of m8 reported in its system info.
+type hardwareModel uint8
+
+const (
+	hardwareModelHeadless hardwareModel = iota
+	hardwareModelBeta
+	hardwareModelProduction
+	hardwareModelModel02
+)
+
+func (m hardwareModel) String() string {
+	switch m {
+	case hardwareModelHeadless:
+		return "headless M8"
+	case hardwareModelBeta:
+		return "beta M8"
+	case hardwareModelProduction:
+		return "M8"
+	case hardwareModelModel02:
+		return "M8 Model:02"
+	default:
+		return fmt.Sprintf("unknown M8 (%d)", uint8(m))
 	}
+}
 
-	for x, y := range c.waveform {
-		renderer.waveform[x] = sdl.Point{X: int32(x), Y: int32(y)}
+// screenSize returns the size of the model's screen.
+func (m hardwareModel) screenSize() size {
+	if m == hardwareModelModel02 {
+		return size{480, 320}
 	}
 
-	if err := sdlRenderer.DrawPoints(renderer.waveform[:]); err != nil {
+	return defaultScreenSize
+}
+
+type firmwareVersion struct {
+	major, minor, patch uint8
+}
+
+func (v firmwareVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+// SystemInfoCmd is sent by newer firmware when the display is enabled and whenever the font mode changes.
+type SystemInfoCmd struct {
+	model    hardwareModel
+	firmware firmwareVersion
+
+	// fontMode is as the m8 sent it, so it may be one newer firmware has that we don't know.
+	fontMode fontMode
+}
+
+func (c SystemInfoCmd) execute(ctrlCtx *controllerContext) error {
+	renderer := ctrlCtx.renderer
+
+	ctrlCtx.logger.Printf("connected to %s running firmware %s\n", c.model, c.firmware)
+
+	if err := renderer.setScreenSize(c.model.screenSize()); err != nil {
 		return err
 	}
 
+	if c.fontMode >= fontModeCount {
+		ctrlCtx.logger.Printf("unknown font mode %d; using the small font\n", c.fontMode)
+		c.fontMode = fontModeSmall
+	}
+
+	renderer.setFontMode(c.fontMode)
+	renderer.showSystemInfo(c)
+
 	return nil
 }
 
@@ -202,6 +227,8 @@ type JoypadKeyPressedCmd struct {
 }
 
 func (c JoypadKeyPressedCmd) execute(ctrlCtx *controllerContext) error {
-	// TODO: impl
+	renderer := ctrlCtx.renderer
+	renderer.setJoypadKeys(c.key, renderer.joypad.local)
+
 	return nil
 }
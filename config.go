@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// config is the client's configuration, taken from the command line and the environment.
+type config struct {
+	// deviceName is the serial port to use; if empty, the m8 is discovered automatically.
+	deviceName string
+
+	// listDevices prints the serial ports found and exits.
+	listDevices bool
+
+	// reconnectPollRate is how often to look for the device after it's been disconnected.
+	reconnectPollRate time.Duration
+
+	// keepaliveInterval is how often to re-send the enable command to the m8.
+	keepaliveInterval time.Duration
+
+	// watchdogTimeout is how long the m8 can go without sending anything before the display is reset.
+	watchdogTimeout time.Duration
+
+	// recordPath is where to record the session's serial traffic to, if anywhere.
+	recordPath string
+
+	// replayPath is a capture file to play back instead of talking to a device.
+	replayPath string
+
+	// replaySpeed scales the timing of the replay; 0 plays it back as fast as possible.
+	replaySpeed float64
+
+	// screenshotDir is where screenshots are saved.
+	screenshotDir string
+
+	// screenshotScale is how much to upscale screenshots by, in addition to saving them at native resolution.
+	screenshotScale int
+
+	// videoPath is where to record video of the session to, if anywhere.
+	videoPath string
+
+	// macroPath is the file macros are recorded to (F5) and played from (F6).
+	macroPath string
+
+	// macroTempo speeds macros up when they're played back; 2 plays them twice as fast.
+	macroTempo float64
+
+	// automationAddr is where to accept automation commands from scripts, if anywhere: a Unix socket path, or
+	// tcp:HOST:PORT on localhost.
+	automationAddr string
+
+	// dumpText prints the text on the m8's screen to stdout whenever it changes.
+	dumpText bool
+
+	// windowMode is the window mode to start in.
+	windowMode windowMode
+
+	// fullscreenMode is the mode to toggle to (with alt+enter) from windowed.
+	fullscreenMode windowMode
+
+	// windowSize is the size of the window when windowed; if unset, the size it had last time is used.
+	windowSize *windowGeometry
+
+	// scaleMode is how the m8's screen is scaled to fit the window.
+	scaleMode scaleMode
+
+	// scaleFilter is how the m8's screen is filtered when it's scaled.
+	scaleFilter scaleFilter
+
+	// borderColor is the color around the m8's screen; if nil, it follows the m8's background color.
+	borderColor *color
+
+	// effects are the post-processing effects to start with; F9 cycles through presets.
+	effects postEffect
+
+	// joypadOverlay shows the m8's buttons over its screen; F8 toggles it.
+	joypadOverlay bool
+
+	// theme is the name of the color theme to start with; F10 cycles through themes.
+	theme string
+
+	// themeFile is a JSON file of extra themes; if empty, themes.json in the config dir is used if it exists.
+	themeFile string
+
+	// fontPath and largeFontPath are fonts to use instead of the built in one for the m8's small and large font
+	// modes.
+	fontPath      string
+	largeFontPath string
+
+	// accelerated asks for a hardware accelerated renderer rather than a software one.
+	accelerated bool
+
+	// vsync syncs presenting frames to the display's refresh.
+	vsync bool
+
+	// fps caps how many frames are presented a second; 0 presents every change as soon as vsync allows.
+	fps int
+
+	// frameStatsInterval is how often to log frame stats; 0 doesn't log them.
+	frameStatsInterval time.Duration
+}
+
+func parseConfig(args []string) (config, error) {
+	var (
+		cfg   config
+		flags = flag.NewFlagSet("m8client", flag.ContinueOnError)
+	)
+
+	flags.StringVar(&cfg.deviceName, "device", os.Getenv("M8_DEV"), "serial port of the m8 (default: discover automatically)")
+	flags.BoolVar(&cfg.listDevices, "list-devices", false, "list the serial ports found and exit")
+	flags.DurationVar(&cfg.keepaliveInterval, "keepalive", 10*time.Second, "how often to re-send the enable command to the m8 (0 to disable)")
+	flags.DurationVar(&cfg.watchdogTimeout, "watchdog", 5*time.Second, "reset the display if the m8 sends nothing for this long (0 to disable)")
+	flags.DurationVar(&cfg.reconnectPollRate, "reconnect-poll-rate", time.Second, "how often to look for the m8 after it's been disconnected")
+	flags.StringVar(&cfg.recordPath, "record", "", "record the session's serial traffic to this capture file")
+	flags.StringVar(&cfg.replayPath, "replay", "", "play back this capture file instead of talking to an m8")
+	flags.Float64Var(&cfg.replaySpeed, "replay-speed", 1, "speed multiplier for --replay (0 for as fast as possible)")
+	flags.StringVar(&cfg.screenshotDir, "screenshot-dir", ".", "where to save screenshots (F12)")
+	flags.IntVar(&cfg.screenshotScale, "screenshot-scale", 0, "also save screenshots upscaled by this integer factor")
+	flags.StringVar(&cfg.videoPath, "video", "", "record video of the session to this file (.gif for an animated GIF; anything else for raw frames plus an index)")
+	flags.StringVar(&cfg.macroPath, "macro", "macro.txt", "file to record macros to (F5) and play them from (F6; Esc aborts)")
+
+	cfg.macroTempo = 1
+	flags.Func("macro-tempo", "speed multiplier for playing macros (default 1)", func(s string) error {
+		if _, err := fmt.Sscan(s, &cfg.macroTempo); err != nil || cfg.macroTempo <= 0 {
+			return errors.Errorf("invalid macro tempo %q", s)
+		}
+
+		return nil
+	})
+	flags.StringVar(&cfg.automationAddr, "automation", "", "accept JSON automation commands on this Unix socket, or on tcp:HOST:PORT on localhost")
+	flags.BoolVar(&cfg.dumpText, "dump-text", false, "print the text on the m8's screen to stdout whenever it changes")
+
+	cfg.windowMode, cfg.fullscreenMode = windowModeFullscreen, windowModeBorderless
+	flags.Func("window-mode", "window mode to start in: windowed, borderless or fullscreen (default fullscreen)", func(s string) (err error) {
+		cfg.windowMode, err = parseWindowMode(s)
+		return err
+	})
+	flags.Func("fullscreen-mode", "mode alt+enter switches to from windowed: borderless or fullscreen (default borderless)", func(s string) (err error) {
+		cfg.fullscreenMode, err = parseWindowMode(s)
+		return err
+	})
+	flags.Func("window-size", "size of the window when windowed, as WIDTHxHEIGHT (default: the size it was last time)", func(s string) error {
+		var geometry windowGeometry
+		if _, err := fmt.Sscanf(s, "%dx%d", &geometry.Width, &geometry.Height); err != nil || geometry.Width <= 0 || geometry.Height <= 0 {
+			return errors.Errorf("invalid window size %q", s)
+		}
+
+		cfg.windowSize = &geometry
+		return nil
+	})
+
+	flags.Func("scale", "how to scale the m8's screen: fit, integer or stretch (default fit)", func(s string) (err error) {
+		cfg.scaleMode, err = parseScaleMode(s)
+		return err
+	})
+	flags.Func("filter", "how to filter the m8's screen when scaling: nearest or linear (default nearest)", func(s string) (err error) {
+		cfg.scaleFilter, err = parseScaleFilter(s)
+		return err
+	})
+	flags.Func("border-color", "color around the m8's screen as RRGGBB (default: the m8's background color)", func(s string) error {
+		c, err := parseColor(s)
+		if err != nil {
+			return err
+		}
+
+		cfg.borderColor = &c
+		return nil
+	})
+	flags.Func("effects", "post-processing effects: off, lcd, crt or a list of scanlines, grid, bloom and curvature (default off; F9 cycles presets)", func(s string) (err error) {
+		cfg.effects, err = parsePostEffects(s)
+		return err
+	})
+	flags.StringVar(&cfg.theme, "theme", "", "color theme to start with: off, high-contrast, colorblind, monochrome or one from --theme-file (default off; F10 cycles themes)")
+	flags.BoolVar(&cfg.joypadOverlay, "joypad-overlay", false, "show the m8's buttons over its screen, highlighting the pressed ones (F8 toggles)")
+	flags.StringVar(&cfg.fontPath, "font", "", "BDF font or PNG atlas to use for the m8's small font, with metrics in a .json file of the same name (default: built in)")
+	flags.StringVar(&cfg.largeFontPath, "large-font", "", "BDF font or PNG atlas to use for the m8's large font (default: the small font)")
+	flags.StringVar(&cfg.themeFile, "theme-file", "", "JSON file of extra color themes (default: themes.json in the config dir, if there is one)")
+
+	flags.BoolVar(&cfg.accelerated, "accelerated", true, "use a hardware accelerated renderer if there is one (--accelerated=false for software)")
+	flags.BoolVar(&cfg.vsync, "vsync", true, "sync presenting frames to the display's refresh")
+	flags.IntVar(&cfg.fps, "fps", 60, "most frames to present a second (0 to present every change, paced by vsync)")
+	flags.DurationVar(&cfg.frameStatsInterval, "frame-stats", 0, "log frame stats this often (0 to disable)")
+
+	if err := flags.Parse(args); err != nil {
+		return config{}, err
+	}
+
+	return cfg, nil
+}
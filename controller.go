@@ -4,6 +4,8 @@ import (
 	"io"
 	"log"
 	"m8client/input"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -15,22 +17,54 @@ type controllerContext struct {
 
 type slipRdr interface {
 	Read(io.ReadWriter) ([]byte, error)
-	Decode([]byte) ([]slipPacket, error)
-	DecodeCommand([]byte) (cmd, error)
+	Decode([]byte) []slipPacket
+	DecodeCommand([]byte, *cmdBatch) error
+	Stats() slipStats
+	Protocol() displayProtocol
+	Reset()
 }
 
 type controller struct {
 	logger *log.Logger
 
-	renderer *renderer
-	slip     slipRdr
-	device   io.ReadWriter
+	renderer   *renderer
+	scheduler  *frameScheduler
+	slip       slipRdr
+	device     io.ReadWriter
+	supervisor *deviceSupervisor
 
 	lastInput   input.CmdKey
 	inputReader inputReader
+
+	// reconnected is set by the read goroutine once the m8's reconnected, so the main loop can send it the keys held
+	// again.
+	reconnected atomic.Bool
+
+	// physicalKeys are held on the input reader and scriptKeys by automation scripts; the m8 gets both.
+	physicalKeys input.CmdKey
+	scriptKeys   input.CmdKey
+
+	// scriptPlayer is playing a script's timed keys, and scriptReply is waiting to hear when it's done.
+	scriptPlayer *input.MacroPlayer
+	scriptReply  chan<- automationResponse
+
+	// macroPath is where macros are recorded to and played from, with their delays divided by macroTempo.
+	macroPath     string
+	macroTempo    float64
+	macroRecorder *input.MacroRecorder
+	macroPlayer   *input.MacroPlayer
+
+	// lastPacketAt is when the last SLIP packet was received, in unix nanoseconds.
+	lastPacketAt atomic.Int64
+
+	// slipErrors is the number of SLIP framing errors last reported.
+	slipErrors uint64
+
+	// protocol is the display protocol last reported.
+	protocol displayProtocol
 }
 
-func (c controller) enableAndResetDisplay() error {
+func (c *controller) enableAndResetDisplay() error {
 	if _, err := c.device.Write([]byte{'E', 'R'}); err != nil {
 		return errors.Wrap(err, "error resetting display")
 	}
@@ -38,28 +72,80 @@ func (c controller) enableAndResetDisplay() error {
 	return nil
 }
 
-func (c *controller) nextCmds() ([]cmd, error) {
+// nextCmds reads the next commands from the device and decodes them into batch, which is emptied first.
+func (c *controller) nextCmds(batch *cmdBatch) error {
+	batch.reset()
+
 	buf, err := c.slip.Read(c.device)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	packets, err := c.slip.Decode(buf)
-	if err != nil {
-		return nil, err
+	packets := c.slip.Decode(buf)
+
+	if len(packets) > 0 {
+		c.lastPacketAt.Store(time.Now().UnixNano())
+	}
+
+	if stats := c.slip.Stats(); stats.errors() != c.slipErrors {
+		c.slipErrors = stats.errors()
+		c.logger.Printf("SLIP framing errors; resynchronised (%s)\n", stats)
 	}
 
-	var cmds []cmd
 	for _, packet := range packets {
-		cmd, err := c.slip.DecodeCommand(packet)
-		if err != nil {
-			return nil, errors.Wrapf(err, "error decoding packet %v as command", packet)
+		if err := c.slip.DecodeCommand(packet, batch); err != nil {
+			return errors.Wrapf(err, "error decoding packet %v as command", packet)
 		}
+	}
 
-		cmds = append(cmds, cmd)
+	if protocol := c.slip.Protocol(); protocol != c.protocol {
+		c.protocol = protocol
+		c.logger.Printf("m8 is using display protocol %s\n", protocol)
 	}
 
-	return cmds, nil
+	return nil
+}
+
+// keepalive keeps the headless display session alive.
+//
+// Every keepaliveInterval the enable command is re-sent, and if no packets have arrived for watchdogTimeout the
+// display is re-enabled and reset. Either can be disabled by passing 0.
+func (c *controller) keepalive(keepaliveInterval, watchdogTimeout time.Duration) {
+	c.logger.Printf("keepalive every %s; watchdog after %s\n", keepaliveInterval, watchdogTimeout)
+
+	var keepaliveTick, watchdogTick <-chan time.Time
+	if keepaliveInterval > 0 {
+		keepaliveTick = time.NewTicker(keepaliveInterval).C
+	}
+	if watchdogTimeout > 0 {
+		watchdogTick = time.NewTicker(watchdogTimeout / 2).C
+	}
+
+	c.lastPacketAt.Store(time.Now().UnixNano())
+
+	for {
+		select {
+		case <-keepaliveTick:
+			if _, err := c.device.Write([]byte{'E'}); err != nil && !isDisconnected(err) {
+				c.logger.Printf("error sending keepalive: %s\n", err)
+			}
+
+		case <-watchdogTick:
+			quiet := time.Since(time.Unix(0, c.lastPacketAt.Load()))
+			if quiet < watchdogTimeout {
+				continue
+			}
+
+			c.logger.Printf("no packets for %s; resetting display\n", quiet.Round(time.Millisecond))
+
+			// Give the m8 another full timeout to respond before trying again.
+			c.lastPacketAt.Store(time.Now().UnixNano())
+
+			if err := c.enableAndResetDisplay(); err != nil && !isDisconnected(err) {
+				c.logger.Printf("error resetting display: %s\n", err)
+			}
+		}
+	}
 }
 
 func (c *controller) executeCmd(cmd cmd) error {
@@ -80,6 +166,22 @@ func (errQuitRequested) Error() string {
 }
 
 func (c *controller) sendInput() error {
+	now := time.Now()
+
+	if c.reconnected.Swap(false) {
+		if err := c.resendKeys(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.stepMacro(now); err != nil {
+		return err
+	}
+
+	if err := c.stepScript(now); err != nil {
+		return err
+	}
+
 	inpt, err := c.inputReader.GetInput()
 	if err != nil {
 		return errors.Wrap(err, "error updating input")
@@ -87,23 +189,78 @@ func (c *controller) sendInput() error {
 
 	switch val := inpt.(type) {
 	case input.CmdKey:
-		// If nothing's changed, bail.
-		if c.lastInput == val {
+		c.physicalKeys = val
+
+		// The macro has the keys while it's playing.
+		if c.macroPlayer != nil {
 			return nil
 		}
 
-		// Update last input.
-		c.lastInput = val
+		return c.sendHeldKeys()
 
-		// Send input.
-		if _, err := c.device.Write([]byte{'C', byte(val)}); err != nil {
-			return errors.Wrap(err, "error sending input")
+	// A bad macro file isn't worth quitting over.
+	case input.CmdMacroRecord:
+		if err := c.toggleMacroRecording(now); err != nil {
+			c.logger.Printf("error recording macro: %s\n", err)
 		}
 
 		return nil
 
+	case input.CmdMacroPlay:
+		if err := c.playMacro(now); err != nil {
+			c.logger.Printf("error playing macro: %s\n", err)
+		}
+
+		return nil
+
+	case input.CmdMacroAbort:
+		return c.abortMacro()
+
 	case input.CmdRequestFullScreen:
-		c.renderer.toggleFullscreen()
+		if err := c.renderer.toggleFullscreen(); err != nil {
+			return errors.Wrap(err, "error toggling fullscreen")
+		}
+
+		return nil
+
+	case input.CmdWindowChanged:
+		if err := c.renderer.windowChanged(); err != nil {
+			return errors.Wrap(err, "error updating window")
+		}
+
+		// Some drivers lose render targets when the window changes size, so have the m8 redraw everything.
+		if val.Resized {
+			if _, err := c.device.Write([]byte{'R'}); err != nil {
+				return errors.Wrap(err, "error resetting display")
+			}
+		}
+
+		return nil
+
+	case input.CmdScreenshot:
+		c.renderer.requestScreenshot()
+		return nil
+
+	case input.CmdCycleTheme:
+		c.logger.Printf("theme: %s\n", c.renderer.themes.next())
+
+		// Have the m8 redraw everything in the new colors.
+		if _, err := c.device.Write([]byte{'R'}); err != nil {
+			return errors.Wrap(err, "error resetting display")
+		}
+
+		return nil
+
+	case input.CmdToggleJoypad:
+		c.renderer.toggleJoypad()
+		return nil
+
+	case input.CmdToggleStatus:
+		c.renderer.toggleStatus()
+		return nil
+
+	case input.CmdCycleEffects:
+		c.logger.Printf("effects: %s\n", c.renderer.cycleEffects())
 		return nil
 
 	case input.CmdRequestExit:
@@ -115,6 +272,93 @@ func (c *controller) sendInput() error {
 	}
 }
 
-func (c *controller) render() error {
-	return c.renderer.render()
+// resendKeys sends the keys held to a newly connected m8, which hasn't had any. While a macro's playing, its next
+// change sends them instead.
+func (c *controller) resendKeys() error {
+	c.lastInput = 0
+
+	if c.macroPlayer != nil {
+		return nil
+	}
+
+	return c.sendHeldKeys()
+}
+
+// sendHeldKeys sends the keys held on the input reader and by scripts.
+func (c *controller) sendHeldKeys() error {
+	return c.sendKeys(c.physicalKeys | c.scriptKeys)
+}
+
+// sendKeys sends the keys held to the m8, if they've changed.
+func (c *controller) sendKeys(keys input.CmdKey) error {
+	// If nothing's changed, bail.
+	if c.lastInput == keys {
+		return nil
+	}
+
+	// Send input.
+	if _, err := c.device.Write([]byte{'C', byte(keys)}); err != nil {
+		return errors.Wrap(err, "error sending input")
+	}
+
+	// Update last input.
+	c.lastInput = keys
+	c.renderer.setJoypadKeys(c.renderer.joypad.remote, uint8(keys))
+
+	if c.macroRecorder != nil {
+		c.macroRecorder.Record(time.Now(), keys)
+	}
+
+	return nil
+}
+
+// reconnect shows a disconnected screen, waits for the device to come back and then re-enables the display.
+func (c *controller) reconnect() error {
+	c.showDisconnected()
+
+	c.supervisor.reconnect()
+
+	// Anything half-read from the old connection is garbage now.
+	c.slip.Reset()
+
+	if err := c.enableAndResetDisplay(); err != nil && !isDisconnected(err) {
+		return err
+	}
+
+	c.reconnected.Store(true)
+
+	return nil
+}
+
+func (c *controller) showDisconnected() {
+	c.scheduler.submitCmds(showDisconnectedCmd{})
+}
+
+// showDisconnectedCmd clears the screen and says the m8's been disconnected.
+type showDisconnectedCmd struct{}
+
+func (showDisconnectedCmd) execute(ctrlCtx *controllerContext) error {
+	const text = "M8 DISCONNECTED"
+
+	var (
+		fg      = color{0xff, 0xff, 0xff}
+		bg      = color{0x00, 0x00, 0x00}
+		screen  = ctrlCtx.renderer.screen
+		metrics = ctrlCtx.renderer.font.metrics
+		chWidth = int16(metrics.GlyphWidth)
+		x       = (screen.width - int16(len(text))*chWidth) / 2
+		y       = (screen.height - int16(metrics.GlyphHeight)) / 2
+	)
+
+	if err := (DrawRectCmd{position{0, 0}, screen, bg}).execute(ctrlCtx); err != nil {
+		return err
+	}
+
+	for i, ch := range []byte(text) {
+		if err := (DrawCharCmd{ch, position{x + int16(i)*chWidth, y}, fg, bg}).execute(ctrlCtx); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
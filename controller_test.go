@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"m8client/input"
+	"testing"
+	"time"
+)
+
+// heldKeysReader is an input reader with keys held the whole time.
+type heldKeysReader struct {
+	keys input.CmdKey
+}
+
+func (r heldKeysReader) GetInput() (input.Cmd, error) {
+	return r.keys, nil
+}
+
+func (heldKeysReader) PollRate() time.Duration {
+	return time.Millisecond
+}
+
+func TestKeysResentAfterReconnect(t *testing.T) {
+	keys, err := input.ParseKeys("down")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		device = &bytes.Buffer{}
+		ctrl   = controller{
+			logger:      log.New(io.Discard, "", 0),
+			renderer:    newRenderer(newFramebufferRenderBackend()),
+			device:      device,
+			inputReader: heldKeysReader{keys},
+		}
+		want = []byte{'C', byte(keys)}
+	)
+
+	if err := ctrl.sendInput(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(device.Bytes(), want) {
+		t.Fatalf("got %x sent", device.Bytes())
+	}
+
+	// Still held, so there's nothing to send.
+	device.Reset()
+	if err := ctrl.sendInput(); err != nil {
+		t.Fatal(err)
+	}
+
+	if device.Len() != 0 {
+		t.Fatalf("got %x sent for keys already sent", device.Bytes())
+	}
+
+	// As reconnect does once the m8's back.
+	ctrl.reconnected.Store(true)
+
+	if err := ctrl.sendInput(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(device.Bytes(), want) {
+		t.Fatalf("got %x sent after reconnecting", device.Bytes())
+	}
+}
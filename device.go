@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+const (
+	// m8USBVendorID is the USB vendor id the m8 (a Teensy) enumerates with.
+	m8USBVendorID = "16C0"
+
+	// m8USBProductID is the USB product id the m8 (a Teensy) enumerates with.
+	m8USBProductID = "048A"
+)
+
+// deviceRank describes how likely it is that a serial port is an m8.
+type deviceRank int
+
+const (
+	// deviceRankUnlikely is a port that doesn't look like an m8 at all.
+	deviceRankUnlikely deviceRank = iota
+
+	// deviceRankName is a port whose name looks like a USB CDC device (e.g. /dev/ttyACM0).
+	deviceRankName
+
+	// deviceRankVIDPID is a port whose USB VID/PID matches the m8.
+	deviceRankVIDPID
+)
+
+func (r deviceRank) String() string {
+	switch r {
+	case deviceRankVIDPID:
+		return "vid/pid match"
+	case deviceRankName:
+		return "name match"
+	default:
+		return "unlikely"
+	}
+}
+
+type deviceCandidate struct {
+	name    string
+	details *enumerator.PortDetails
+	rank    deviceRank
+}
+
+func (c deviceCandidate) String() string {
+	if c.details == nil || !c.details.IsUSB {
+		return fmt.Sprintf("%s (%s)", c.name, c.rank)
+	}
+
+	return fmt.Sprintf("%s (%s; usb %s:%s; serial %q)", c.name, c.rank, c.details.VID, c.details.PID, c.details.SerialNumber)
+}
+
+// findDevices enumerates the serial ports on this machine and ranks them by how likely they are to be an m8.
+//
+// Candidates are returned best match first.
+func findDevices() ([]deviceCandidate, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, errors.Wrap(err, "error enumerating serial ports")
+	}
+
+	return rankDevices(ports), nil
+}
+
+// rankDevices ranks ports by how likely they are to be an m8, best match first.
+func rankDevices(ports []*enumerator.PortDetails) []deviceCandidate {
+	candidates := make([]deviceCandidate, 0, len(ports))
+	for _, port := range ports {
+		candidates = append(candidates, deviceCandidate{port.Name, port, rankDevice(port)})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].rank != candidates[j].rank {
+			return candidates[i].rank > candidates[j].rank
+		}
+
+		return candidates[i].name < candidates[j].name
+	})
+
+	return candidates
+}
+
+func rankDevice(port *enumerator.PortDetails) deviceRank {
+	if port.IsUSB && strings.EqualFold(port.VID, m8USBVendorID) && strings.EqualFold(port.PID, m8USBProductID) {
+		return deviceRankVIDPID
+	}
+
+	// On macOS every device shows up as both a tty.* and cu.* port; the cu.* one is the one we want, so only
+	// the cu.* port gets to match on name.
+	for _, prefix := range []string{"/dev/ttyACM", "/dev/cu.usbmodem", "COM"} {
+		if strings.HasPrefix(port.Name, prefix) {
+			return deviceRankName
+		}
+	}
+
+	return deviceRankUnlikely
+}
+
+// chooseDevice returns name if it's been given, or otherwise the name of the port most likely to be an m8 of those
+// found by find.
+func chooseDevice(name string, find func() ([]deviceCandidate, error)) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+
+	candidates, err := find()
+	if err != nil {
+		return "", err
+	}
+
+	if len(candidates) == 0 || candidates[0].rank == deviceRankUnlikely {
+		return "", errors.New("no m8 found; is it plugged in? (set M8_DEV to choose a device manually)")
+	}
+
+	return candidates[0].name, nil
+}
+
+// listDevices writes every serial port found to w along with its rank.
+func listDevices(w io.Writer) error {
+	candidates, err := findDevices()
+	if err != nil {
+		return err
+	}
+
+	if len(candidates) == 0 {
+		fmt.Fprintln(w, "no serial ports found")
+		return nil
+	}
+
+	for _, candidate := range candidates {
+		fmt.Fprintln(w, candidate)
+	}
+
+	return nil
+}
+
+// openDevice opens the serial port with the given name.
+//
+// If name is empty, the port is discovered with findDevices.
+func openDevice(logger *log.Logger, name string) (serial.Port, error) {
+	name, err := chooseDevice(name, findDevices)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Printf("opening device %s\n", name)
+
+	dev, err := serial.Open(name, &serial.Mode{
+		BaudRate: 9000,
+		Parity:   serial.NoParity,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening device %s", name)
+	}
+
+	return dev, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"go.bug.st/serial/enumerator"
+)
+
+func TestChooseDevice(t *testing.T) {
+	var (
+		m8          = &enumerator.PortDetails{Name: "/dev/ttyACM1", IsUSB: true, VID: "16c0", PID: "048a"}
+		otherUSB    = &enumerator.PortDetails{Name: "/dev/ttyACM0", IsUSB: true, VID: "2341", PID: "0043"}
+		macOtherTTY = &enumerator.PortDetails{Name: "/dev/tty.usbmodem1", IsUSB: true, VID: "2341", PID: "0043"}
+		bluetooth   = &enumerator.PortDetails{Name: "/dev/cu.Bluetooth-Incoming-Port"}
+		builtIn     = &enumerator.PortDetails{Name: "/dev/ttyS0"}
+	)
+
+	tests := []struct {
+		name     string
+		device   string
+		ports    []*enumerator.PortDetails
+		want     string
+		wantRank []deviceRank
+	}{
+		{
+			name:     "m8 ahead of other usb serial ports",
+			ports:    []*enumerator.PortDetails{otherUSB, builtIn, m8},
+			want:     m8.Name,
+			wantRank: []deviceRank{deviceRankVIDPID, deviceRankName, deviceRankUnlikely},
+		},
+		{
+			name:     "usb serial port without the m8's vid/pid",
+			ports:    []*enumerator.PortDetails{builtIn, otherUSB, macOtherTTY},
+			want:     otherUSB.Name,
+			wantRank: []deviceRank{deviceRankName, deviceRankUnlikely, deviceRankUnlikely},
+		},
+		{
+			name:     "no usb serial ports",
+			ports:    []*enumerator.PortDetails{builtIn, bluetooth},
+			wantRank: []deviceRank{deviceRankUnlikely, deviceRankUnlikely},
+		},
+		{
+			name:     "explicit device",
+			device:   "/dev/ttyUSB3",
+			ports:    []*enumerator.PortDetails{m8, otherUSB},
+			want:     "/dev/ttyUSB3",
+			wantRank: []deviceRank{deviceRankVIDPID, deviceRankName},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			candidates := rankDevices(test.ports)
+
+			for i, candidate := range candidates {
+				if candidate.rank != test.wantRank[i] {
+					t.Errorf("got %s at %d, want it ranked %s", candidate, i, test.wantRank[i])
+				}
+			}
+
+			found := false
+			got, err := chooseDevice(test.device, func() ([]deviceCandidate, error) {
+				found = true
+				return candidates, nil
+			})
+
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("got %s, want no m8 found", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+
+			if test.device != "" && found {
+				t.Error("looked for devices despite being given one")
+			}
+		})
+	}
+}
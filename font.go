@@ -1,5 +1,7 @@
 package main
 
+import "image"
+
 const fontWidth = 128
 const fontHeight = 64
 const fontChsPerRow = 16
@@ -72,3 +74,24 @@ var fontData = []byte{
 	0xfe, 0xef, 0xfe, 0xe0, 0xe3, 0xe0, 0xfc, 0xe0, 0xee, 0xe0, 0xe0, 0xe0, 0xfb, 0xe0, 0xff, 0xc0,
 	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
 }
+
+// defaultFont is the font built in to the client, made from fontData.
+var defaultFont = newDefaultFont()
+
+func newDefaultFont() *font {
+	atlas := image.NewAlpha(image.Rect(0, 0, fontWidth, fontHeight))
+	for y := 0; y < fontHeight; y++ {
+		for x := 0; x < fontWidth; x++ {
+			// The font data is 1 bit per pixel, left to right and then top to bottom; a 0 bit is a set pixel.
+			if i := y*fontWidth + x; fontData[i/8]&(1<<(i%8)) == 0 {
+				atlas.Pix[atlas.PixOffset(x, y)] = 0xff
+			}
+		}
+	}
+
+	return &font{
+		name:    "default",
+		metrics: defaultFontMetrics(fontChWidth, fontChHeight),
+		atlas:   atlas,
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// fontMode is which of its fonts the m8 is drawing with.
+type fontMode uint8
+
+const (
+	fontModeSmall fontMode = iota
+	fontModeLarge
+
+	fontModeCount
+)
+
+// fontMetrics describes a font's glyphs and how they're laid out relative to the positions the m8 sends.
+type fontMetrics struct {
+	// GlyphWidth and GlyphHeight are the size of each glyph's cell in the atlas.
+	GlyphWidth  int `json:"glyph_width"`
+	GlyphHeight int `json:"glyph_height"`
+
+	// GlyphX and GlyphY are where a glyph's top left corner goes relative to a character's position.
+	GlyphX int `json:"glyph_x"`
+	GlyphY int `json:"glyph_y"`
+
+	// BackgroundX, BackgroundY, BackgroundWidth and BackgroundHeight are the rectangle filled behind a character with
+	// a background, relative to its position.
+	BackgroundX      int `json:"background_x"`
+	BackgroundY      int `json:"background_y"`
+	BackgroundWidth  int `json:"background_width"`
+	BackgroundHeight int `json:"background_height"`
+
+	// FirstChar is the character of the first glyph in the atlas.
+	FirstChar int `json:"first_char"`
+}
+
+// defaultFontMetrics lays out glyphs of the given size the way the m8 lays out its small font: glyphs sit 3 pixels
+// below a character's position, with a background a pixel bigger on the left, top and bottom.
+func defaultFontMetrics(width, height int) fontMetrics {
+	return fontMetrics{
+		GlyphWidth:       width,
+		GlyphHeight:      height,
+		GlyphY:           3,
+		BackgroundX:      -1,
+		BackgroundY:      2,
+		BackgroundWidth:  width - 1,
+		BackgroundHeight: height + 1,
+	}
+}
+
+// font is a bitmap font: an atlas of glyphs laid out in a grid, left to right and then top to bottom.
+type font struct {
+	name    string
+	metrics fontMetrics
+
+	// atlas is 0xff where a glyph's pixel is set and 0 where it isn't.
+	atlas *image.Alpha
+}
+
+// glyph returns where ch's glyph is in the atlas, or false if the font doesn't have one.
+func (f *font) glyph(ch byte) (image.Rectangle, bool) {
+	var (
+		i       = int(ch) - f.metrics.FirstChar
+		columns = f.atlas.Rect.Dx() / f.metrics.GlyphWidth
+		rows    = f.atlas.Rect.Dy() / f.metrics.GlyphHeight
+	)
+
+	if i < 0 || i >= columns*rows {
+		return image.Rectangle{}, false
+	}
+
+	var (
+		x = (i % columns) * f.metrics.GlyphWidth
+		y = (i / columns) * f.metrics.GlyphHeight
+	)
+
+	return image.Rect(x, y, x+f.metrics.GlyphWidth, y+f.metrics.GlyphHeight), true
+}
+
+// pixel returns whether the pixel at x, y of ch's glyph is set.
+func (f *font) pixel(ch byte, x, y int) bool {
+	rect, ok := f.glyph(ch)
+	if !ok {
+		return false
+	}
+
+	return f.atlas.AlphaAt(rect.Min.X+x, rect.Min.Y+y).A != 0
+}
+
+// glyphPosition returns where to draw the glyph for a character at pos.
+func (f *font) glyphPosition(pos position) position {
+	return position{pos.x + int16(f.metrics.GlyphX), pos.y + int16(f.metrics.GlyphY)}
+}
+
+// background returns the rectangle to fill behind a character at pos.
+func (f *font) background(pos position) (position, size) {
+	return position{pos.x + int16(f.metrics.BackgroundX), pos.y + int16(f.metrics.BackgroundY)},
+		size{int16(f.metrics.BackgroundWidth), int16(f.metrics.BackgroundHeight)}
+}
+
+// loadFont loads a font from a BDF file or a PNG atlas.
+//
+// Metrics are read from a JSON file next to the font with the same name (font.png and font.json, say). A PNG atlas
+// has to have one, since there's no other way of knowing how big its glyphs are; for a BDF font, anything left out
+// is laid out like the default font.
+func loadFont(path string) (*font, error) {
+	metricsPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".json"
+
+	metrics, hasMetrics, err := readFontMetrics(metricsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening font")
+	}
+	defer file.Close()
+
+	var (
+		f             = font{name: filepath.Base(path)}
+		width, height int
+	)
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".bdf":
+		if f.atlas, width, height, err = parseBDF(file); err != nil {
+			return nil, errors.Wrapf(err, "error parsing font %s", path)
+		}
+
+	case ".png":
+		if !hasMetrics {
+			return nil, errors.Errorf("PNG font %s needs metrics in %s", path, metricsPath)
+		}
+
+		if f.atlas, err = decodeFontAtlas(file); err != nil {
+			return nil, errors.Wrapf(err, "error decoding font %s", path)
+		}
+
+	default:
+		return nil, errors.Errorf("unsupported font %s (expected .bdf or .png)", path)
+	}
+
+	if hasMetrics {
+		// The defaults for everything else depend on the glyph size, so that has to be read first.
+		var sized fontMetrics
+		if err := json.Unmarshal(metrics, &sized); err != nil {
+			return nil, errors.Wrapf(err, "error parsing font metrics %s", metricsPath)
+		}
+
+		if sized.GlyphWidth != 0 || sized.GlyphHeight != 0 {
+			width, height = sized.GlyphWidth, sized.GlyphHeight
+		}
+	}
+
+	f.metrics = defaultFontMetrics(width, height)
+	if hasMetrics {
+		if err := json.Unmarshal(metrics, &f.metrics); err != nil {
+			return nil, errors.Wrapf(err, "error parsing font metrics %s", metricsPath)
+		}
+	}
+
+	if f.metrics.GlyphWidth <= 0 || f.metrics.GlyphHeight <= 0 {
+		return nil, errors.Errorf("invalid glyph size %dx%d for font %s", f.metrics.GlyphWidth, f.metrics.GlyphHeight, path)
+	}
+
+	return &f, nil
+}
+
+// readFontMetrics reads the font metrics file at path, if there is one.
+func readFontMetrics(path string) ([]byte, bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "error reading font metrics")
+	}
+
+	return data, true, nil
+}
+
+// decodeFontAtlas decodes an image of glyphs; a pixel's set if it's opaque and light, so both white on transparent
+// and white on black work.
+func decodeFontAtlas(r io.Reader) (*image.Alpha, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, bounds.Min, draw.Src)
+
+	atlas := image.NewAlpha(rgba.Rect)
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		var (
+			r, g, b, a = int(rgba.Pix[i]), int(rgba.Pix[i+1]), int(rgba.Pix[i+2]), int(rgba.Pix[i+3])
+		)
+
+		if a >= 0x80 && (r+g+b)/3 >= 0x80 {
+			atlas.Pix[i/4] = 0xff
+		}
+	}
+
+	return atlas, nil
+}
+
+// bdfAtlasColumns is how many glyphs go in each row of the atlas built for a BDF font.
+const bdfAtlasColumns = 16
+
+// parseBDF parses a BDF font into an atlas of its first 256 characters, with each glyph in a cell the size of the
+// font's bounding box.
+func parseBDF(r io.Reader) (*image.Alpha, int, int, error) {
+	var (
+		scanner = bufio.NewScanner(r)
+
+		atlas          *image.Alpha
+		cellW, cellH   int
+		cellX, cellY   int
+		encoding       = -1
+		glyphW, glyphH int
+		glyphX, glyphY int
+		bitmapRow      = -1
+		lineNo         int
+	)
+
+	for scanner.Scan() {
+		lineNo++
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if bitmapRow >= 0 {
+			if fields[0] == "ENDCHAR" {
+				bitmapRow = -1
+				continue
+			}
+
+			if encoding >= 0 && encoding < 256 && bitmapRow < glyphH {
+				var bits uint64
+				if _, err := fmt.Sscanf(fields[0], "%x", &bits); err != nil {
+					return nil, 0, 0, errors.Errorf("line %d: invalid bitmap row %q", lineNo, fields[0])
+				}
+
+				var (
+					rowBits = len(fields[0]) * 4
+					originX = (encoding%bdfAtlasColumns)*cellW + glyphX - cellX
+					originY = (encoding/bdfAtlasColumns)*cellH + (cellH + cellY) - (glyphH + glyphY) + bitmapRow
+				)
+
+				for x := 0; x < glyphW && x < rowBits; x++ {
+					if bits&(1<<(rowBits-1-x)) != 0 && (image.Point{originX + x, originY}).In(atlas.Rect) {
+						atlas.Pix[atlas.PixOffset(originX+x, originY)] = 0xff
+					}
+				}
+			}
+
+			bitmapRow++
+			continue
+		}
+
+		var err error
+		switch fields[0] {
+		case "FONTBOUNDINGBOX":
+			err = scanBDFInts(fields, &cellW, &cellH, &cellX, &cellY)
+			if err == nil && (cellW <= 0 || cellH <= 0) {
+				err = errors.Errorf("invalid bounding box %dx%d", cellW, cellH)
+			}
+			if err == nil {
+				atlas = image.NewAlpha(image.Rect(0, 0, cellW*bdfAtlasColumns, cellH*256/bdfAtlasColumns))
+			}
+
+		case "STARTCHAR":
+			encoding = -1
+
+		case "ENCODING":
+			err = scanBDFInts(fields, &encoding)
+
+		case "BBX":
+			err = scanBDFInts(fields, &glyphW, &glyphH, &glyphX, &glyphY)
+
+		case "BITMAP":
+			if atlas == nil {
+				err = errors.New("glyph before FONTBOUNDINGBOX")
+			}
+			bitmapRow = 0
+		}
+
+		if err != nil {
+			return nil, 0, 0, errors.Wrapf(err, "line %d", lineNo)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	if atlas == nil {
+		return nil, 0, 0, errors.New("no FONTBOUNDINGBOX")
+	}
+
+	return atlas, cellW, cellH, nil
+}
+
+func scanBDFInts(fields []string, values ...*int) error {
+	if len(fields) < len(values)+1 {
+		return errors.Errorf("expected %d values for %s", len(values), fields[0])
+	}
+
+	for i, value := range values {
+		if _, err := fmt.Sscan(fields[i+1], value); err != nil {
+			return errors.Errorf("invalid %s value %q", fields[0], fields[i+1])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testBDF = `STARTFONT 2.1
+FONT test
+SIZE 4 75 75
+FONTBOUNDINGBOX 4 5 0 -1
+CHARS 1
+STARTCHAR A
+ENCODING 65
+BBX 3 4 0 0
+BITMAP
+40
+A0
+E0
+A0
+ENDCHAR
+ENDFONT
+`
+
+func TestLoadBDFFont(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "test.bdf")
+	if err := os.WriteFile(path, []byte(testBDF), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "test.json"), []byte(`{"glyph_y": 1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := loadFont(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The glyph sits on the baseline, which is a row above the bottom of its 4x5 cell.
+	want := []string{
+		".#..",
+		"#.#.",
+		"###.",
+		"#.#.",
+		"....",
+	}
+
+	for y, row := range want {
+		for x, px := range row {
+			if got := f.pixel('A', x, y); got != (px == '#') {
+				t.Errorf("pixel %d, %d: got %v", x, y, got)
+			}
+		}
+	}
+
+	// Metrics left out of the metrics file are laid out like the default font.
+	if want := (fontMetrics{4, 5, 0, 1, -1, 2, 3, 6, 0}); f.metrics != want {
+		t.Errorf("got metrics %+v, want %+v", f.metrics, want)
+	}
+}
+
+func TestLargeFontOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "large.bdf")
+	if err := os.WriteFile(path, []byte(testBDF), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	renderer := newRenderer(newFramebufferRenderBackend())
+	if err := loadFonts(log.New(io.Discard, "", 0), renderer, config{largeFontPath: path}); err != nil {
+		t.Fatal(err)
+	}
+
+	if renderer.font != defaultFont {
+		t.Fatalf("small font mode is using %s; want the default font", renderer.font.name)
+	}
+
+	renderer.setFontMode(fontModeLarge)
+	if renderer.font.name != "large.bdf" {
+		t.Fatalf("large font mode is using %s; want large.bdf", renderer.font.name)
+	}
+
+	renderer.setFontMode(fontModeSmall)
+	if renderer.font != defaultFont {
+		t.Fatalf("small font mode is using %s after switching back; want the default font", renderer.font.name)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"image"
+	imagecolor "image/color"
+	"image/draw"
+)
+
+// framebufferRenderBackend draws to an in-memory image the size of the m8's screen.
+//
+// It doesn't need a display, so it's handy for tests and anything else that wants the screen's pixels.
+type framebufferRenderBackend struct {
+	frame *image.RGBA
+
+	// presented is the number of frames presented so far.
+	presented int
+}
+
+func newFramebufferRenderBackend() *framebufferRenderBackend {
+	return &framebufferRenderBackend{
+		frame: image.NewRGBA(image.Rect(0, 0, int(defaultScreenSize.width), int(defaultScreenSize.height))),
+	}
+}
+
+func (c color) rgba() imagecolor.RGBA {
+	return imagecolor.RGBA{c.r, c.g, c.b, 0xff}
+}
+
+func (b *framebufferRenderBackend) fillRect(pos position, size size, c color) error {
+	rect := image.Rect(int(pos.x), int(pos.y), int(pos.x)+int(size.width), int(pos.y)+int(size.height))
+	draw.Draw(b.frame, rect, image.NewUniform(c.rgba()), image.Point{}, draw.Src)
+
+	return nil
+}
+
+func (b *framebufferRenderBackend) drawGlyph(f *font, ch byte, pos position, c color) error {
+	rgba := c.rgba()
+
+	for y := 0; y < f.metrics.GlyphHeight; y++ {
+		for x := 0; x < f.metrics.GlyphWidth; x++ {
+			if f.pixel(ch, x, y) {
+				b.frame.SetRGBA(int(pos.x)+x, int(pos.y)+y, rgba)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *framebufferRenderBackend) drawPoints(points []position, c color) error {
+	rgba := c.rgba()
+
+	for _, point := range points {
+		b.frame.SetRGBA(int(point.x), int(point.y), rgba)
+	}
+
+	return nil
+}
+
+func (b *framebufferRenderBackend) present() error {
+	b.presented++
+	return nil
+}
+
+func (b *framebufferRenderBackend) resize(screen size) error {
+	b.frame = image.NewRGBA(image.Rect(0, 0, int(screen.width), int(screen.height)))
+	return nil
+}
+
+func (b *framebufferRenderBackend) snapshot() (*image.RGBA, error) {
+	frame := image.NewRGBA(b.frame.Rect)
+	copy(frame.Pix, b.frame.Pix)
+
+	return frame, nil
+}
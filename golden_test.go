@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden images in testdata")
+
+// renderPackets decodes the SLIP encoded packets and executes them against a framebuffer.
+func renderPackets(t *testing.T, packets ...[]byte) (*renderer, *framebufferRenderBackend) {
+	t.Helper()
+
+	var data []byte
+	for _, packet := range packets {
+		data = slipEncode(data, packet)
+	}
+
+	var (
+		rdr      = &slipReader{}
+		backend  = newFramebufferRenderBackend()
+		renderer = newRenderer(backend)
+		ctx      = &controllerContext{log.New(io.Discard, "", 0), renderer}
+	)
+
+	decoded := rdr.Decode(data)
+
+	if len(decoded) != len(packets) {
+		t.Fatalf("expected %d packets; got %d", len(packets), len(decoded))
+	}
+
+	var batch cmdBatch
+	for _, packet := range decoded {
+		if err := rdr.DecodeCommand(packet, &batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, cmd := range batch.cmds {
+		if err := cmd.execute(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return renderer, backend
+}
+
+// assertGolden compares frame to testdata/name.png, or overwrites it when running with -update.
+func assertGolden(t *testing.T, name string, frame *image.RGBA) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".png")
+
+	if *updateGolden {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("error opening golden image (run with -update to create it): %s", err)
+	}
+	defer file.Close()
+
+	golden, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if golden.Bounds() != frame.Bounds() {
+		t.Fatalf("expected frame of %v; got %v", golden.Bounds(), frame.Bounds())
+	}
+
+	var (
+		diffs int
+		first image.Point
+	)
+	for y := frame.Rect.Min.Y; y < frame.Rect.Max.Y; y++ {
+		for x := frame.Rect.Min.X; x < frame.Rect.Max.X; x++ {
+			if golden.At(x, y) != frame.At(x, y) {
+				if diffs == 0 {
+					first = image.Pt(x, y)
+				}
+
+				diffs++
+			}
+		}
+	}
+
+	if diffs > 0 {
+		actual := filepath.Join(t.TempDir(), name+".png")
+		if file, err := os.Create(actual); err == nil {
+			png.Encode(file, frame)
+			file.Close()
+		}
+
+		t.Fatalf("%d pixels differ from %s, starting at %v: expected %v; got %v (actual frame written to %s)", diffs, path, first, golden.At(first.X, first.Y), frame.At(first.X, first.Y), actual)
+	}
+}
+
+var (
+	goldenBg        = color{0x10, 0x10, 0x30}
+	goldenFg        = color{0xfa, 0xfa, 0xfa}
+	goldenHighlight = color{0x00, 0xdb, 0xc0}
+	goldenRed       = color{0xff, 0x30, 0x30}
+)
+
+func TestDrawRectGolden(t *testing.T) {
+	renderer, backend := renderPackets(t,
+		encodeRect(0, 0, defaultScreenSize.width, defaultScreenSize.height, goldenBg),
+		encodeRect(10, 20, 100, 50, goldenHighlight),
+		encodeRect(300, 230, 40, 40, goldenRed),
+
+		// Not the whole screen, so this mustn't change the background color.
+		encodeRect(0, 0, defaultScreenSize.width, defaultScreenSize.height-1, goldenFg),
+		encodeRect(0, 100, defaultScreenSize.width, 10, goldenBg),
+	)
+
+	if renderer.bgColor != goldenBg {
+		t.Errorf("expected background color %v; got %v", goldenBg, renderer.bgColor)
+	}
+
+	assertGolden(t, "draw_rect", backend.frame)
+}
+
+func TestDrawCharGolden(t *testing.T) {
+	packets := [][]byte{encodeRect(0, 0, defaultScreenSize.width, defaultScreenSize.height, goldenBg)}
+
+	// Same foreground and background: only the glyph is drawn.
+	for i, ch := range []byte("SONG 00 01 --") {
+		packets = append(packets, encodeChar(ch, int16(i)*8, 10, goldenFg, goldenFg))
+	}
+
+	// Different background: the cell behind the glyph is filled too.
+	for i, ch := range []byte("PHRASE C-4 7F") {
+		packets = append(packets, encodeChar(ch, int16(i)*8, 30, goldenBg, goldenHighlight))
+	}
+
+	// Every glyph in the font.
+	for ch := 0; ch < 128; ch++ {
+		packets = append(packets, encodeChar(byte(ch), int16(ch%32)*10, 60+int16(ch/32)*12, goldenFg, goldenRed))
+	}
+
+	_, backend := renderPackets(t, packets...)
+
+	assertGolden(t, "draw_char", backend.frame)
+}
+
+func TestDrawOscWaveformGolden(t *testing.T) {
+	waveform := make([]byte, defaultScreenSize.width)
+	for x := range waveform {
+		waveform[x] = byte(15 + (x%40-20)*(x%40-20)/30)
+	}
+
+	t.Run("on", func(t *testing.T) {
+		_, backend := renderPackets(t,
+			encodeRect(0, 0, defaultScreenSize.width, defaultScreenSize.height, goldenBg),
+
+			// The waveform clears the top of the screen with the background color before drawing.
+			encodeRect(0, 0, defaultScreenSize.width, 60, goldenRed),
+			encodeWaveform(goldenHighlight, waveform),
+		)
+
+		assertGolden(t, "draw_osc_waveform", backend.frame)
+	})
+
+	t.Run("off", func(t *testing.T) {
+		_, backend := renderPackets(t,
+			encodeRect(0, 0, defaultScreenSize.width, defaultScreenSize.height, goldenBg),
+			encodeRect(0, 0, defaultScreenSize.width, 60, goldenRed),
+			encodeWaveform(goldenHighlight, waveform),
+			encodeWaveform(goldenHighlight, nil),
+		)
+
+		assertGolden(t, "draw_osc_waveform_off", backend.frame)
+	})
+}
+
+func TestSystemInfoResizesScreen(t *testing.T) {
+	waveform := make([]byte, 480)
+	for x := range waveform {
+		waveform[x] = 20
+	}
+
+	renderer, backend := renderPackets(t,
+		[]byte{systemInfoOpCode, byte(hardwareModelModel02), 4, 0, 1, byte(fontModeSmall)},
+		encodeRect(0, 0, 480, 320, goldenBg),
+		encodeRect(470, 310, 10, 10, goldenFg),
+		encodeWaveform(goldenHighlight, waveform),
+	)
+
+	if want := (size{480, 320}); renderer.screen != want {
+		t.Errorf("got screen %+v, want %+v", renderer.screen, want)
+	}
+
+	if got := backend.frame.Bounds().Size(); got != image.Pt(480, 320) {
+		t.Errorf("got frame size %v", got)
+	}
+
+	if got := backend.frame.RGBAAt(479, 319); got != goldenFg.rgba() {
+		t.Errorf("got %v in the bottom right corner of the larger screen", got)
+	}
+
+	if got := backend.frame.RGBAAt(479, 20); got != goldenHighlight.rgba() {
+		t.Errorf("got %v at the end of the waveform", got)
+	}
+
+	// The background follows the full screen rect for the larger screen.
+	if renderer.bgColor != goldenBg {
+		t.Errorf("got background %v", renderer.bgColor)
+	}
+}
@@ -1,5 +1,11 @@
 package input
 
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
 type Cmd interface {
 	isInput()
 }
@@ -19,10 +25,110 @@ const (
 	keyEdit   CmdKey = 1
 )
 
+// keyNames are the names of the keys, as ParseKeys takes them.
+var keyNames = []struct {
+	name string
+	key  CmdKey
+}{
+	{"left", keyLeft},
+	{"up", keyUp},
+	{"down", keyDown},
+	{"select", keySelect},
+	{"start", keyStart},
+	{"right", keyRight},
+	{"option", keyOption},
+	{"edit", keyEdit},
+}
+
+// ParseKeys parses the names of keys joined with '+', like "select+edit", or "none" for none. The names are left,
+// up, down, select, start, right, option and edit.
+func ParseKeys(s string) (CmdKey, error) {
+	if s == "none" {
+		return 0, nil
+	}
+
+	var keys CmdKey
+
+outer:
+	for _, name := range strings.Split(s, "+") {
+		for _, key := range keyNames {
+			if key.name == strings.ToLower(name) {
+				keys |= key.key
+				continue outer
+			}
+		}
+
+		return 0, errors.Errorf("unknown key %q", name)
+	}
+
+	return keys, nil
+}
+
+func (k CmdKey) String() string {
+	var names []string
+	for _, key := range keyNames {
+		if k&key.key != 0 {
+			names = append(names, key.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, "+")
+}
+
 type CmdRequestFullScreen struct{}
 
 func (CmdRequestFullScreen) isInput() {}
 
+// CmdWindowChanged is sent when the window's been moved or resized.
+type CmdWindowChanged struct {
+	Resized bool
+}
+
+func (CmdWindowChanged) isInput() {}
+
 type CmdRequestExit struct{}
 
 func (CmdRequestExit) isInput() {}
+
+type CmdScreenshot struct{}
+
+func (CmdScreenshot) isInput() {}
+
+// CmdCycleTheme switches to the next color theme.
+type CmdCycleTheme struct{}
+
+func (CmdCycleTheme) isInput() {}
+
+// CmdCycleEffects switches to the next set of post-processing effects.
+type CmdCycleEffects struct{}
+
+func (CmdCycleEffects) isInput() {}
+
+// CmdToggleStatus pins or unpins the overlay showing the m8's status.
+type CmdToggleStatus struct{}
+
+func (CmdToggleStatus) isInput() {}
+
+// CmdToggleJoypad shows or hides the overlay showing the m8's buttons.
+type CmdToggleJoypad struct{}
+
+func (CmdToggleJoypad) isInput() {}
+
+// CmdMacroRecord starts recording a macro, or stops and saves the one being recorded.
+type CmdMacroRecord struct{}
+
+func (CmdMacroRecord) isInput() {}
+
+// CmdMacroPlay plays the saved macro.
+type CmdMacroPlay struct{}
+
+func (CmdMacroPlay) isInput() {}
+
+// CmdMacroAbort stops the macro playing and releases its keys.
+type CmdMacroAbort struct{}
+
+func (CmdMacroAbort) isInput() {}
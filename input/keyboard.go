@@ -17,6 +17,18 @@ func (r *KeyboardInputReader) PollRate() time.Duration {
 func (r *KeyboardInputReader) GetInput() (Cmd, error) {
 	ev := sdl.PollEvent()
 	switch ev := ev.(type) {
+	case *sdl.QuitEvent:
+		return CmdRequestExit{}, nil
+
+	case *sdl.WindowEvent:
+		switch ev.Event {
+		case sdl.WINDOWEVENT_MOVED:
+			return CmdWindowChanged{}, nil
+
+		case sdl.WINDOWEVENT_SIZE_CHANGED:
+			return CmdWindowChanged{Resized: true}, nil
+		}
+
 	case *sdl.KeyboardEvent:
 		if ev.Type == sdl.KEYUP {
 			switch ev.Keysym.Sym {
@@ -27,6 +39,30 @@ func (r *KeyboardInputReader) GetInput() (Cmd, error) {
 
 			case sdl.K_q:
 				return CmdRequestExit{}, nil
+
+			case sdl.K_F12, sdl.K_PRINTSCREEN:
+				return CmdScreenshot{}, nil
+
+			case sdl.K_ESCAPE:
+				return CmdMacroAbort{}, nil
+
+			case sdl.K_F5:
+				return CmdMacroRecord{}, nil
+
+			case sdl.K_F6:
+				return CmdMacroPlay{}, nil
+
+			case sdl.K_F8:
+				return CmdToggleJoypad{}, nil
+
+			case sdl.K_F9:
+				return CmdCycleEffects{}, nil
+
+			case sdl.K_F10:
+				return CmdCycleTheme{}, nil
+
+			case sdl.K_F11:
+				return CmdToggleStatus{}, nil
 			}
 		}
 
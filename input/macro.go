@@ -0,0 +1,159 @@
+package input
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MacroEvent is a change in which keys are held, Delay after the event before it.
+type MacroEvent struct {
+	Delay time.Duration
+	Keys  CmdKey
+}
+
+// Macro is a recorded sequence of key changes.
+//
+// Macro files have one event per line: the delay since the previous event, as a Go duration, and the keys held from
+// then on, as ParseKeys takes them. Blank lines and lines starting with '#' are ignored:
+//
+//	# clear a phrase
+//	0s select
+//	40ms select+edit
+//	120ms none
+type Macro []MacroEvent
+
+// Duration returns how long the macro takes to play at normal tempo.
+func (m Macro) Duration() time.Duration {
+	var d time.Duration
+	for _, event := range m {
+		d += event.Delay
+	}
+
+	return d
+}
+
+// ReadMacro reads a macro file.
+func ReadMacro(r io.Reader) (Macro, error) {
+	var (
+		scanner = bufio.NewScanner(r)
+		macro   Macro
+		lineNo  int
+	)
+
+	for scanner.Scan() {
+		lineNo++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("line %d: expected a delay and keys", lineNo)
+		}
+
+		delay, err := time.ParseDuration(fields[0])
+		if err != nil || delay < 0 {
+			return nil, errors.Errorf("line %d: invalid delay %q", lineNo, fields[0])
+		}
+
+		keys, err := ParseKeys(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNo)
+		}
+
+		macro = append(macro, MacroEvent{delay, keys})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return macro, nil
+}
+
+// WriteMacro writes a macro file.
+func WriteMacro(w io.Writer, m Macro) error {
+	for _, event := range m {
+		if _, err := fmt.Fprintf(w, "%s %s\n", event.Delay, event.Keys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MacroRecorder records key changes into a macro.
+type MacroRecorder struct {
+	macro Macro
+	last  time.Time
+}
+
+// NewMacroRecorder starts recording at now.
+func NewMacroRecorder(now time.Time) *MacroRecorder {
+	return &MacroRecorder{last: now}
+}
+
+// Record records that keys are held from now on.
+func (r *MacroRecorder) Record(now time.Time, keys CmdKey) {
+	r.macro = append(r.macro, MacroEvent{now.Sub(r.last), keys})
+	r.last = now
+}
+
+// Macro returns what's been recorded so far.
+func (r *MacroRecorder) Macro() Macro {
+	return r.macro
+}
+
+// MacroPlayer plays a macro back.
+type MacroPlayer struct {
+	macro Macro
+	tempo float64
+
+	// next is the index of the next event, which is due at due.
+	next int
+	due  time.Time
+}
+
+// NewMacroPlayer starts playing m at now, with its delays divided by tempo.
+func NewMacroPlayer(m Macro, tempo float64, now time.Time) *MacroPlayer {
+	p := MacroPlayer{macro: m, tempo: tempo, due: now}
+	if len(m) > 0 {
+		p.due = now.Add(p.scale(m[0].Delay))
+	}
+
+	return &p
+}
+
+func (p *MacroPlayer) scale(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / p.tempo)
+}
+
+// Next returns the keys to hold next, if they're due to change at now.
+//
+// Events that fell due between polls are returned one at a time, so call it until it returns false.
+func (p *MacroPlayer) Next(now time.Time) (CmdKey, bool) {
+	if p.next >= len(p.macro) || now.Before(p.due) {
+		return 0, false
+	}
+
+	keys := p.macro[p.next].Keys
+
+	p.next++
+	if p.next < len(p.macro) {
+		p.due = p.due.Add(p.scale(p.macro[p.next].Delay))
+	}
+
+	return keys, true
+}
+
+// Done returns whether every event has been played.
+func (p *MacroPlayer) Done() bool {
+	return p.next >= len(p.macro)
+}
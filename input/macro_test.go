@@ -0,0 +1,72 @@
+package input
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMacroFile(t *testing.T) {
+	macro := Macro{
+		{0, keySelect},
+		{40 * time.Millisecond, keySelect | keyEdit},
+		{120 * time.Millisecond, 0},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteMacro(&buf, macro); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "0s select\n40ms select+edit\n120ms none\n"; buf.String() != want {
+		t.Fatalf("wrote %q, want %q", buf.String(), want)
+	}
+
+	read, err := ReadMacro(strings.NewReader("# comment\n\n" + buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(read, macro) {
+		t.Fatalf("read %v, want %v", read, macro)
+	}
+
+	for _, bad := range []string{"10ms", "soon edit", "-1s edit", "10ms jump"} {
+		if _, err := ReadMacro(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error reading %q", bad)
+		}
+	}
+}
+
+func TestMacroPlayerTempo(t *testing.T) {
+	var (
+		start  = time.Unix(0, 0)
+		player = NewMacroPlayer(Macro{
+			{100 * time.Millisecond, keyUp},
+			{100 * time.Millisecond, 0},
+			{0, keyDown},
+		}, 2, start)
+	)
+
+	if _, ok := player.Next(start.Add(49 * time.Millisecond)); ok {
+		t.Fatal("first event played early")
+	}
+
+	if keys, ok := player.Next(start.Add(50 * time.Millisecond)); !ok || keys != keyUp {
+		t.Fatalf("got %v, %v at 50ms; want up", keys, ok)
+	}
+
+	// Both of the rest are due by now, and come out one at a time.
+	now := start.Add(200 * time.Millisecond)
+	for _, want := range []CmdKey{0, keyDown} {
+		if keys, ok := player.Next(now); !ok || keys != want {
+			t.Fatalf("got %v, %v; want %v", keys, ok, want)
+		}
+	}
+
+	if !player.Done() {
+		t.Fatal("expected the macro to be done")
+	}
+}
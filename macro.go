@@ -0,0 +1,125 @@
+package main
+
+import (
+	"m8client/input"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// toggleMacroRecording starts recording a macro of the keys sent to the m8, or stops and saves the one being
+// recorded.
+func (c *controller) toggleMacroRecording(now time.Time) error {
+	if c.macroPlayer != nil {
+		c.logger.Println("can't record a macro while one's playing")
+		return nil
+	}
+
+	if c.macroRecorder == nil {
+		c.macroRecorder = input.NewMacroRecorder(now)
+
+		// Start from whatever's held now, so playing it back doesn't depend on what was held when it started.
+		c.macroRecorder.Record(now, c.lastInput)
+
+		c.logger.Printf("recording macro to %s (F5 to stop)\n", c.macroPath)
+		return nil
+	}
+
+	// Let go of anything still held at the end.
+	if c.lastInput != 0 {
+		c.macroRecorder.Record(now, 0)
+	}
+
+	macro := c.macroRecorder.Macro()
+	c.macroRecorder = nil
+
+	file, err := os.Create(c.macroPath)
+	if err != nil {
+		return errors.Wrap(err, "error creating macro file")
+	}
+	defer file.Close()
+
+	if err := input.WriteMacro(file, macro); err != nil {
+		return errors.Wrap(err, "error writing macro file")
+	}
+
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "error writing macro file")
+	}
+
+	c.logger.Printf("recorded macro of %d key changes (%s) to %s\n", len(macro), macro.Duration().Round(time.Millisecond), c.macroPath)
+
+	return nil
+}
+
+// playMacro starts playing the saved macro.
+func (c *controller) playMacro(now time.Time) error {
+	if c.macroRecorder != nil {
+		c.logger.Println("can't play a macro while recording one")
+		return nil
+	}
+
+	if c.macroPlayer != nil {
+		return nil
+	}
+
+	file, err := os.Open(c.macroPath)
+	if os.IsNotExist(err) {
+		c.logger.Printf("no macro recorded to %s yet (F5 to record one)\n", c.macroPath)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "error opening macro file")
+	}
+	defer file.Close()
+
+	macro, err := input.ReadMacro(file)
+	if err != nil {
+		return errors.Wrapf(err, "error reading macro file %s", c.macroPath)
+	}
+
+	c.logger.Printf("playing macro %s at %gx tempo (Esc to abort)\n", c.macroPath, c.macroTempo)
+	c.macroPlayer = input.NewMacroPlayer(macro, c.macroTempo, now)
+
+	return nil
+}
+
+// abortMacro stops the macro playing, if there is one, and goes back to the keys held outside it.
+func (c *controller) abortMacro() error {
+	if c.macroPlayer == nil {
+		return nil
+	}
+
+	c.macroPlayer = nil
+	c.logger.Println("macro aborted")
+
+	return c.sendHeldKeys()
+}
+
+// stepMacro sends the playing macro's key changes that are due at now.
+func (c *controller) stepMacro(now time.Time) error {
+	if c.macroPlayer == nil {
+		return nil
+	}
+
+	for {
+		keys, ok := c.macroPlayer.Next(now)
+		if !ok {
+			break
+		}
+
+		if err := c.sendKeys(keys); err != nil {
+			return err
+		}
+	}
+
+	if c.macroPlayer.Done() {
+		c.macroPlayer = nil
+		c.logger.Println("macro finished")
+
+		return c.sendHeldKeys()
+	}
+
+	return nil
+}
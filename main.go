@@ -1,27 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"m8client/input"
 	"os"
+	"runtime"
 	"runtime/debug"
 	"time"
 
 	"github.com/pkg/errors"
 	gpio "github.com/stianeikeland/go-rpio/v4"
-	"go.bug.st/serial"
+	"github.com/veandco/go-sdl2/sdl"
 )
 
-var defaultDeviceName = "/dev/cu.usbmodem136136901"
-
-const (
-	// m8ScreenWidth is the actual width of the m8's screen.
-	m8ScreenWidth int32 = 320
+func init() {
+	// SDL wants to be called from the main thread, and everything that calls it runs on the main goroutine.
+	runtime.LockOSThread()
+}
 
-	// m8ScreenHeight is the actual height of the m8's screen.
-	m8ScreenHeight int32 = 240
-)
+// defaultScreenSize is the size of the m8's screen until it reports a model with a different one.
+var defaultScreenSize = size{320, 240}
 
 func main() {
 	defer func() {
@@ -30,25 +31,93 @@ func main() {
 		}
 	}()
 
+	cfg, err := parseConfig(os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
+
+	if cfg.listDevices {
+		if err := listDevices(os.Stdout); err != nil {
+			panic(err)
+		}
+
+		return
+	}
+
 	logger := log.New(os.Stderr, "m8client", log.Flags())
 
-	devName := defaultDeviceName
-	if val, ok := os.LookupEnv("M8_DEV"); ok {
-		devName = val
+	var (
+		device     io.ReadWriter
+		supervisor *deviceSupervisor
+	)
+	if cfg.replayPath != "" {
+		file, err := os.Open(cfg.replayPath)
+		if err != nil {
+			panic(errors.Wrap(err, "error opening capture file"))
+		}
+		defer file.Close()
+
+		replay, err := newReplayDevice(bufio.NewReader(file), cfg.replaySpeed)
+		if err != nil {
+			panic(err)
+		}
+
+		logger.Printf("replaying capture %s recorded at %s\n", cfg.replayPath, replay.capture.start.Format(time.RFC3339))
+		device = replay
+	} else {
+		supervisor = newDeviceSupervisor(logger, func() (io.ReadWriteCloser, error) {
+			return openDevice(logger, cfg.deviceName)
+		}, cfg.reconnectPollRate)
+
+		device = supervisor
 	}
 
-	dev, err := serial.Open(devName, &serial.Mode{
-		BaudRate: 9000,
-		Parity:   serial.NoParity,
-	})
-	if err != nil {
-		panic(errors.Wrap(err, "error opening device"))
+	if cfg.recordPath != "" {
+		capture, err := newCaptureWriter(cfg.recordPath)
+		if err != nil {
+			panic(err)
+		}
+		defer capture.Close()
+
+		logger.Printf("recording session to %s\n", cfg.recordPath)
+		device = recordingDevice{logger, device, capture}
 	}
 
-	renderer, err := newRenderer(1280, 720)
+	backend, err := newSDLRenderBackend(newSDLWindowConfig(cfg))
 	if err != nil {
 		panic(errors.Wrap(err, "error creating renderer"))
 	}
+	defer func() {
+		if err := backend.Close(); err != nil {
+			logger.Printf("error closing window: %s\n", err)
+		}
+	}()
+
+	if backend.accelerated {
+		logger.Println("using accelerated renderer")
+	} else {
+		logger.Println("using software renderer")
+	}
+
+	renderer := newRenderer(backend)
+	if err := loadFonts(logger, renderer, cfg); err != nil {
+		panic(err)
+	}
+
+	renderer.joypad.enabled = cfg.joypadOverlay
+	if cfg.dumpText {
+		renderer.textDump = os.Stdout
+	}
+	renderer.screenshotter = newScreenshotter(logger, cfg.screenshotDir, cfg.screenshotScale)
+
+	if cfg.videoPath != "" {
+		if renderer.videoRecorder, err = newVideoRecorder(logger, cfg.videoPath); err != nil {
+			panic(err)
+		}
+		defer renderer.videoRecorder.Close()
+
+		logger.Printf("recording video to %s\n", cfg.videoPath)
+	}
 
 	inputReader, err := newInputReader()
 	if err != nil {
@@ -60,46 +129,178 @@ func main() {
 		panic(errors.Wrap(err, "error creating slip reader"))
 	}
 
+	if renderer.themes, err = loadThemes(cfg.themeFile, cfg.theme); err != nil {
+		panic(errors.Wrap(err, "error loading themes"))
+	}
+
 	controller := controller{
-		logger,
-		renderer,
-		slipReader,
-		dev,
-		0,
-		inputReader,
-	}
-	if err := controller.enableAndResetDisplay(); err != nil {
+		logger:      logger,
+		renderer:    renderer,
+		slip:        slipReader,
+		device:      device,
+		supervisor:  supervisor,
+		inputReader: inputReader,
+		macroPath:   cfg.macroPath,
+		macroTempo:  cfg.macroTempo,
+	}
+
+	scheduler := newFrameScheduler(logger, renderer, controller.executeCmd, cfg.fps)
+	controller.scheduler = scheduler
+	if err := controller.enableAndResetDisplay(); err != nil && !isDisconnected(err) {
 		panic(err)
 	}
 
+	var automation *automationServer
+	if cfg.automationAddr != "" {
+		if automation, err = newAutomationServer(logger, cfg.automationAddr); err != nil {
+			panic(err)
+		}
+		defer automation.Close()
+
+		logger.Printf("accepting automation commands on %s\n", automation.Addr())
+	}
+
+	go controller.keepalive(cfg.keepaliveInterval, cfg.watchdogTimeout)
+
 	go func() {
+		batch := scheduler.batch()
+
 		for {
 			logger.Println("waiting...")
 
-			cmds, err := controller.nextCmds()
+			err := controller.nextCmds(batch)
+			if errors.Cause(err) == io.EOF {
+				logger.Println("replay finished")
+				return
+			}
+			if isDisconnected(err) {
+				if err := controller.reconnect(); err != nil {
+					panic(err)
+				}
+
+				continue
+			}
 			if err != nil {
 				panic(err)
 			}
 
-			for _, cmd := range cmds {
-				if err := controller.executeCmd(cmd); err != nil {
-					panic(err)
-				}
+			scheduler.submit(batch)
+			batch = scheduler.batch()
+		}
+	}()
+
+	var (
+		frameTick <-chan time.Time
+		statsTick <-chan time.Time
+		inputTick = time.NewTicker(inputPollRate(controller.inputReader))
+	)
+	if scheduler.interval > 0 {
+		frameTick = time.NewTicker(scheduler.interval).C
+	}
+	if cfg.frameStatsInterval > 0 {
+		statsTick = time.NewTicker(cfg.frameStatsInterval).C
+	}
+
+	for {
+		// Scripts wait for their timed commands to finish before sending more.
+		var automationRequests <-chan automationRequest
+		if automation != nil && !controller.automationBusy() {
+			automationRequests = automation.requests
+		}
+
+		select {
+		case batch := <-scheduler.batches:
+			if err := scheduler.apply(batch); err != nil {
+				panic(errors.Wrap(err, "error rendering"))
 			}
 
-			if err := controller.render(); err != nil {
+		case now := <-frameTick:
+			if err := scheduler.tick(now); err != nil {
 				panic(errors.Wrap(err, "error rendering"))
 			}
+
+		case req := <-automationRequests:
+			controller.automate(req, time.Now())
+
+		case <-statsTick:
+			scheduler.logStats(cfg.frameStatsInterval)
+
+		case <-inputTick.C:
+			// Input sent while the device is away is dropped; the read loop takes care of reconnecting.
+			if err := controller.sendInput(); err != nil && !isDisconnected(err) {
+				if _, ok := err.(errQuitRequested); ok {
+					return
+				}
+
+				panic(err)
+			}
 		}
-	}()
+	}
+}
 
-	for {
-		<-time.After(controller.inputReader.PollRate())
+// inputPollRate returns how often to poll the input reader.
+//
+// Readers that want to be polled as often as possible get polled every millisecond, so the main loop still has
+// time for everything else.
+func inputPollRate(reader inputReader) time.Duration {
+	if rate := reader.PollRate(); rate > 0 {
+		return rate
+	}
 
-		if err := controller.sendInput(); err != nil {
-			panic(err)
+	return time.Millisecond
+}
+
+func newSDLWindowConfig(cfg config) sdlWindowConfig {
+	geometry := windowGeometry{sdl.WINDOWPOS_CENTERED, sdl.WINDOWPOS_CENTERED, 1280, 720}
+	if saved, ok := loadWindowGeometry(); ok {
+		geometry = saved
+	}
+
+	if cfg.windowSize != nil {
+		geometry.Width, geometry.Height = cfg.windowSize.Width, cfg.windowSize.Height
+	}
+
+	return sdlWindowConfig{
+		mode:           cfg.windowMode,
+		fullscreenMode: cfg.fullscreenMode,
+		geometry:       geometry,
+		scaleMode:      cfg.scaleMode,
+		filter:         cfg.scaleFilter,
+		borderColor:    cfg.borderColor,
+		accelerated:    cfg.accelerated,
+		vsync:          cfg.vsync,
+		effects:        cfg.effects,
+	}
+}
+
+// loadFonts loads the fonts asked for in cfg into renderer; the large font falls back to the small one.
+func loadFonts(logger *log.Logger, renderer *renderer, cfg config) error {
+	for _, font := range []struct {
+		mode fontMode
+		path string
+	}{
+		{fontModeSmall, cfg.fontPath},
+		{fontModeLarge, cfg.largeFontPath},
+	} {
+		if font.path == "" {
+			continue
+		}
+
+		f, err := loadFont(font.path)
+		if err != nil {
+			return err
 		}
+
+		renderer.setFont(font.mode, f)
+
+		if font.mode == fontModeSmall && cfg.largeFontPath == "" {
+			renderer.setFont(fontModeLarge, f)
+		}
+
+		logger.Printf("using font %s (%dx%d)\n", f.name, f.metrics.GlyphWidth, f.metrics.GlyphHeight)
 	}
+
+	return nil
 }
 
 func newInputReader() (inputReader, error) {
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// overlay is drawn over the m8's screen without becoming part of it, so it doesn't show up in screenshots or video
+// and doesn't need the m8 to redraw anything when it goes away.
+type overlay interface {
+	// visible returns whether the overlay is showing at now.
+	visible(now time.Time) bool
+
+	// draw draws the overlay, in the m8's screen space.
+	draw(r *renderer) error
+}
+
+// overlayBackend is a renderBackend that can draw overlays.
+type overlayBackend interface {
+	// drawOverlay clears the overlay and then calls draw with drawing going to the overlay instead of the m8's
+	// screen. With a nil draw, the overlay's just cleared.
+	drawOverlay(draw func() error) error
+}
+
+var (
+	overlayFg = color{0xff, 0xff, 0xff}
+	overlayBg = color{0x20, 0x20, 0x20}
+)
+
+// drawText draws text with the built in font on a solid background, with its top left corner at pos.
+func (r *renderer) drawText(text string, pos position, fg, bg color) error {
+	var (
+		font    = defaultFont
+		width   = int16(len(text) * font.metrics.GlyphWidth)
+		height  = int16(font.metrics.GlyphHeight)
+		padding = int16(1)
+	)
+
+	if err := r.backend.fillRect(position{pos.x - padding, pos.y - padding}, size{width + 2*padding, height + 2*padding}, bg); err != nil {
+		return err
+	}
+
+	for i, ch := range []byte(text) {
+		if err := r.backend.drawGlyph(font, ch, position{pos.x + int16(i*font.metrics.GlyphWidth), pos.y}, fg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// statusOverlayDuration is how long the status overlay shows for when the m8 reports its system info.
+const statusOverlayDuration = 5 * time.Second
+
+// statusOverlay shows what the m8 has reported about itself.
+type statusOverlay struct {
+	lines []string
+
+	// until is when the overlay stops showing, unless it's pinned.
+	until  time.Time
+	pinned bool
+}
+
+// show shows info for statusOverlayDuration.
+func (o *statusOverlay) show(info SystemInfoCmd, screen size) {
+	fontMode := "small font"
+	if info.fontMode == fontModeLarge {
+		fontMode = "large font"
+	}
+
+	o.lines = []string{
+		info.model.String(),
+		fmt.Sprintf("firmware %s", info.firmware),
+		fmt.Sprintf("%dx%d, %s", screen.width, screen.height, fontMode),
+	}
+	o.until = time.Now().Add(statusOverlayDuration)
+}
+
+func (o *statusOverlay) visible(now time.Time) bool {
+	return len(o.lines) > 0 && (o.pinned || now.Before(o.until))
+}
+
+func (o *statusOverlay) draw(r *renderer) error {
+	lineHeight := int16(defaultFont.metrics.GlyphHeight + 3)
+
+	for i, line := range o.lines {
+		var (
+			x = r.screen.width - int16(len(line)*defaultFont.metrics.GlyphWidth) - 3
+			y = r.screen.height - int16(len(o.lines)-i)*lineHeight
+		)
+
+		if err := r.drawText(line, position{x, y}, overlayFg, overlayBg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// joypadButtonSize is the size of each button in the joypad overlay.
+const joypadButtonSize = 10
+
+// joypadButtons are the m8's buttons: their bit in the key state the m8 reports (which is the same as input.CmdKey's),
+// their label and where they are in the joypad overlay.
+var joypadButtons = []struct {
+	bit   uint8
+	label byte
+	pos   position
+}{
+	{1 << 7, '<', position{0, 12}},  // left
+	{1 << 6, '^', position{12, 0}},  // up
+	{1 << 5, 'v', position{12, 12}}, // down
+	{1 << 4, 'S', position{42, 12}}, // select (shift)
+	{1 << 3, 'P', position{54, 12}}, // start (play)
+	{1 << 2, '>', position{24, 12}}, // right
+	{1 << 1, 'O', position{42, 0}},  // option
+	{1 << 0, 'E', position{54, 0}},  // edit
+}
+
+var (
+	joypadReleased = color{0x40, 0x40, 0x40}
+	joypadPressed  = color{0x00, 0xd0, 0xff}
+)
+
+// joypadOverlay shows the m8's buttons, highlighting the ones pressed on the m8 itself or locally.
+type joypadOverlay struct {
+	enabled bool
+
+	// remote is the key state the m8 last reported and local is what's been sent to it.
+	remote uint8
+	local  uint8
+}
+
+func (o *joypadOverlay) visible(now time.Time) bool {
+	return o.enabled
+}
+
+func (o *joypadOverlay) draw(r *renderer) error {
+	var (
+		pressed = o.remote | o.local
+		origin  = position{4, r.screen.height - 2*joypadButtonSize - 6}
+
+		// Labels are centred in their buttons.
+		labelOffset = position{
+			int16(joypadButtonSize-defaultFont.metrics.GlyphWidth) / 2,
+			int16(joypadButtonSize-defaultFont.metrics.GlyphHeight) / 2,
+		}
+	)
+
+	for _, button := range joypadButtons {
+		var (
+			pos = position{origin.x + button.pos.x, origin.y + button.pos.y}
+			bg  = joypadReleased
+		)
+
+		if pressed&button.bit != 0 {
+			bg = joypadPressed
+		}
+
+		if err := r.backend.fillRect(pos, size{joypadButtonSize, joypadButtonSize}, bg); err != nil {
+			return err
+		}
+
+		if err := r.backend.drawGlyph(defaultFont, button.label, position{pos.x + labelOffset.x, pos.y + labelOffset.y}, overlayFg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"log"
+	"m8client/input"
+	"testing"
+)
+
+func TestJoypadKeys(t *testing.T) {
+	keys, err := input.ParseKeys("select+edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		renderer = newRenderer(newFramebufferRenderBackend())
+		ctrl     = controller{
+			logger:   log.New(io.Discard, "", 0),
+			renderer: renderer,
+			device:   &bytes.Buffer{},
+		}
+		ctx = &controllerContext{ctrl.logger, renderer}
+	)
+
+	renderer.dirty = false
+
+	// Pressed on the m8 itself.
+	if err := (JoypadKeyPressedCmd{1 << 6}).execute(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pressed here.
+	if err := ctrl.sendKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+
+	if renderer.joypad.remote != 1<<6 || renderer.joypad.local != uint8(keys) {
+		t.Fatalf("got remote %08b and local %08b, want %08b and %08b", renderer.joypad.remote, renderer.joypad.local, 1<<6, uint8(keys))
+	}
+
+	if renderer.dirty {
+		t.Error("expected keys changing to leave the renderer clean with the overlay hidden")
+	}
+
+	renderer.toggleJoypad()
+	renderer.dirty = false
+
+	if err := (JoypadKeyPressedCmd{0}).execute(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !renderer.dirty {
+		t.Error("expected keys changing to dirty the renderer with the overlay showing")
+	}
+
+	if renderer.joypad.remote != 0 || renderer.joypad.local != uint8(keys) {
+		t.Fatalf("got remote %08b and local %08b after the m8's keys were released", renderer.joypad.remote, renderer.joypad.local)
+	}
+}
+
+// glyphCellBackend records where every glyph's cell is drawn.
+type glyphCellBackend struct {
+	*framebufferRenderBackend
+	cells []image.Rectangle
+}
+
+func (b *glyphCellBackend) drawGlyph(f *font, ch byte, pos position, c color) error {
+	min := image.Pt(int(pos.x), int(pos.y))
+	b.cells = append(b.cells, image.Rectangle{min, min.Add(image.Pt(f.metrics.GlyphWidth, f.metrics.GlyphHeight))})
+
+	return b.framebufferRenderBackend.drawGlyph(f, ch, pos, c)
+}
+
+func TestJoypadLabelsInsideButtons(t *testing.T) {
+	var (
+		backend  = &glyphCellBackend{framebufferRenderBackend: newFramebufferRenderBackend()}
+		renderer = newRenderer(backend)
+		origin   = image.Pt(4, int(renderer.screen.height)-2*joypadButtonSize-6)
+	)
+
+	if err := renderer.joypad.draw(renderer); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backend.cells) != len(joypadButtons) {
+		t.Fatalf("got %d labels drawn for %d buttons", len(backend.cells), len(joypadButtons))
+	}
+
+	for i, button := range joypadButtons {
+		var (
+			min  = origin.Add(image.Pt(int(button.pos.x), int(button.pos.y)))
+			rect = image.Rectangle{min, min.Add(image.Pt(joypadButtonSize, joypadButtonSize))}
+			cell = backend.cells[i]
+		)
+
+		if !cell.In(rect) {
+			t.Errorf("label %q drawn at %v, outside its button at %v", button.label, cell, rect)
+		}
+
+		// Centred, give or take a pixel for odd gaps.
+		if left, right := cell.Min.X-rect.Min.X, rect.Max.X-cell.Max.X; left-right > 1 || right-left > 1 {
+			t.Errorf("label %q drawn at %v, not centred in its button at %v", button.label, cell, rect)
+		}
+	}
+}
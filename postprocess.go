@@ -0,0 +1,365 @@
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// postEffect is a set of post-processing effects applied to the m8's screen before it's shown.
+type postEffect int
+
+const (
+	// effectScanlines darkens every scale'th row, like the gaps between a CRT's scanlines.
+	effectScanlines postEffect = 1 << iota
+
+	// effectPixelGrid darkens the edges of every pixel, like an LCD's pixel grid.
+	effectPixelGrid
+
+	// effectBloom makes bright pixels glow into their neighbours.
+	effectBloom
+
+	// effectCurvature bends the screen like the glass of a CRT.
+	effectCurvature
+)
+
+var postEffectNames = []struct {
+	name   string
+	effect postEffect
+}{
+	{"scanlines", effectScanlines},
+	{"grid", effectPixelGrid},
+	{"bloom", effectBloom},
+	{"curvature", effectCurvature},
+}
+
+// postEffectPresets are the sets of effects cycled through at runtime.
+var postEffectPresets = []postEffect{
+	0,
+	effectScanlines,
+	effectPixelGrid,
+	effectScanlines | effectBloom | effectCurvature,
+}
+
+// parsePostEffects parses a comma separated list of effects, or one of the presets "off", "lcd" or "crt".
+func parsePostEffects(s string) (postEffect, error) {
+	switch strings.ToLower(s) {
+	case "", "off", "none":
+		return 0, nil
+	case "lcd":
+		return effectPixelGrid, nil
+	case "crt":
+		return effectScanlines | effectBloom | effectCurvature, nil
+	}
+
+	var effects postEffect
+
+outer:
+	for _, name := range strings.Split(strings.ToLower(s), ",") {
+		for _, effect := range postEffectNames {
+			if effect.name == strings.TrimSpace(name) {
+				effects |= effect.effect
+				continue outer
+			}
+		}
+
+		return 0, errors.Errorf("unknown effect %q (expected off, lcd, crt or a list of scanlines, grid, bloom and curvature)", name)
+	}
+
+	return effects, nil
+}
+
+func (e postEffect) String() string {
+	if e == 0 {
+		return "off"
+	}
+
+	var names []string
+	for _, effect := range postEffectNames {
+		if e&effect.effect != 0 {
+			names = append(names, effect.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// next returns the preset after e, for cycling through them.
+func (e postEffect) next() postEffect {
+	for i, preset := range postEffectPresets {
+		if preset == e {
+			return postEffectPresets[(i+1)%len(postEffectPresets)]
+		}
+	}
+
+	return postEffectPresets[0]
+}
+
+const (
+	// postProcessScale is how many output pixels each of the m8's pixels becomes, which is what gives scanlines and
+	// the pixel grid room to show up.
+	postProcessScale = 3
+
+	postScanlineLevel = 0.55
+	postGridLevel     = 0.7
+
+	postBloomThreshold = 0.45
+	postBloomStrength  = 0.6
+	postBloomRadius    = 2
+
+	// postCurvature is how far the corners of the screen are pulled in.
+	postCurvature = 0.08
+)
+
+// postProcessor applies post-processing effects to frames.
+//
+// It works entirely on the CPU on images, so it works the same whatever the renderer is.
+type postProcessor struct {
+	effects postEffect
+
+	// width and height are the size of the frames processed.
+	width, height int
+
+	flat *image.RGBA
+	out  *image.RGBA
+
+	// bloom is the glow added to each of the m8's pixels, as RGB from 0 to 1.
+	bloom, blurTmp []float32
+
+	// curve maps each output pixel to the offset of the pixel it shows in flat, or -1 for outside the screen.
+	curve []int32
+}
+
+// newPostProcessor returns a post processor for frames the size of screen.
+func newPostProcessor(effects postEffect, screen size) *postProcessor {
+	var (
+		width  = int(screen.width) * postProcessScale
+		height = int(screen.height) * postProcessScale
+	)
+
+	p := postProcessor{
+		effects: effects,
+		width:   int(screen.width),
+		height:  int(screen.height),
+		flat:    image.NewRGBA(image.Rect(0, 0, width, height)),
+		out:     image.NewRGBA(image.Rect(0, 0, width, height)),
+		bloom:   make([]float32, int(screen.width)*int(screen.height)*3),
+		blurTmp: make([]float32, int(screen.width)*int(screen.height)*3),
+		curve:   make([]int32, width*height),
+	}
+
+	p.buildCurve()
+
+	return &p
+}
+
+// process returns frame with the effects applied, postProcessScale times the size.
+//
+// The image returned is reused by the next call.
+func (p *postProcessor) process(frame *image.RGBA) *image.RGBA {
+	if p.effects&effectBloom != 0 {
+		p.buildBloom(frame)
+	}
+
+	dst := p.out
+	if p.effects&effectCurvature != 0 {
+		dst = p.flat
+	}
+
+	levels := p.levels()
+
+	var (
+		bounds = frame.Bounds()
+		width  = p.width
+		height = p.height
+	)
+
+	for sy := 0; sy < height; sy++ {
+		for sx := 0; sx < width; sx++ {
+			var (
+				c       = frame.RGBAAt(bounds.Min.X+sx, bounds.Min.Y+sy)
+				r, g, b = int32(c.R), int32(c.G), int32(c.B)
+			)
+
+			var br, bg, bb int32
+			if p.effects&effectBloom != 0 {
+				i := (sy*width + sx) * 3
+				br = int32(p.bloom[i] * postBloomStrength * 255)
+				bg = int32(p.bloom[i+1] * postBloomStrength * 255)
+				bb = int32(p.bloom[i+2] * postBloomStrength * 255)
+			}
+
+			// Each of the m8's pixels becomes a block of output pixels, darkened by the scanlines and grid.
+			for dy := 0; dy < postProcessScale; dy++ {
+				off := dst.PixOffset(sx*postProcessScale, sy*postProcessScale+dy)
+				block := dst.Pix[off : off+postProcessScale*4 : off+postProcessScale*4]
+				for dx, l := range levels[dy] {
+					px := block[dx*4 : dx*4+4 : dx*4+4]
+					px[0] = clampByte(r*l>>8 + br)
+					px[1] = clampByte(g*l>>8 + bg)
+					px[2] = clampByte(b*l>>8 + bb)
+					px[3] = 0xff
+				}
+			}
+		}
+	}
+
+	if p.effects&effectCurvature != 0 {
+		for i, src := range p.curve {
+			px := p.out.Pix[i*4 : i*4+4 : i*4+4]
+			if src < 0 {
+				px[0], px[1], px[2], px[3] = 0, 0, 0, 0xff
+				continue
+			}
+
+			from := p.flat.Pix[src : src+4 : src+4]
+			px[0], px[1], px[2], px[3] = from[0], from[1], from[2], from[3]
+		}
+	}
+
+	return p.out
+}
+
+// levels returns how bright each output pixel of a block is, out of 256.
+func (p *postProcessor) levels() (levels [postProcessScale][postProcessScale]int32) {
+	const last = postProcessScale - 1
+
+	for dy := range levels {
+		for dx := range levels[dy] {
+			level := 1.0
+			if p.effects&effectScanlines != 0 && dy == last {
+				level *= postScanlineLevel
+			}
+			if p.effects&effectPixelGrid != 0 && (dx == last || dy == last && p.effects&effectScanlines == 0) {
+				level *= postGridLevel
+			}
+
+			levels[dy][dx] = int32(level * 256)
+		}
+	}
+
+	return levels
+}
+
+// buildBloom picks out the bright pixels of frame and blurs them.
+func (p *postProcessor) buildBloom(frame *image.RGBA) {
+	var (
+		bounds = frame.Bounds()
+		width  = p.width
+		height = p.height
+	)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var (
+				c       = frame.RGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+				r, g, b = float32(c.R) / 255, float32(c.G) / 255, float32(c.B) / 255
+				i       = (y*width + x) * 3
+			)
+
+			if 0.2126*r+0.7152*g+0.0722*b < postBloomThreshold {
+				r, g, b = 0, 0, 0
+			}
+
+			p.bloom[i], p.bloom[i+1], p.bloom[i+2] = r, g, b
+		}
+	}
+
+	// Two passes of a separable box blur come out close enough to a gaussian.
+	for pass := 0; pass < 2; pass++ {
+		boxBlur(p.blurTmp, p.bloom, width, height, 1, 0)
+		boxBlur(p.bloom, p.blurTmp, width, height, 0, 1)
+	}
+}
+
+// boxBlur blurs the RGB triples of src into dst along the direction dx, dy, keeping a running sum of the window.
+func boxBlur(dst, src []float32, width, height, dx, dy int) {
+	const n = 2*postBloomRadius + 1
+
+	var (
+		lines, length = height, width
+		lineStep      = width * 3
+		step          = dx*3 + dy*width*3
+	)
+	if dy != 0 {
+		lines, length = width, height
+		lineStep = 3
+	}
+
+	for line := 0; line < lines; line++ {
+		base := line * lineStep
+
+		var r, g, b float32
+		for k := 0; k <= postBloomRadius && k < length; k++ {
+			i := base + k*step
+			r, g, b = r+src[i], g+src[i+1], b+src[i+2]
+		}
+
+		for k := 0; k < length; k++ {
+			i := base + k*step
+			dst[i], dst[i+1], dst[i+2] = r/n, g/n, b/n
+
+			if in := k + postBloomRadius + 1; in < length {
+				j := base + in*step
+				r, g, b = r+src[j], g+src[j+1], b+src[j+2]
+			}
+			if out := k - postBloomRadius; out >= 0 {
+				j := base + out*step
+				r, g, b = r-src[j], g-src[j+1], b-src[j+2]
+			}
+		}
+	}
+}
+
+// buildCurve works out the barrel distortion lookup for curvature.
+func (p *postProcessor) buildCurve() {
+	var (
+		width  = p.out.Rect.Dx()
+		height = p.out.Rect.Dy()
+	)
+
+	for oy := 0; oy < height; oy++ {
+		for ox := 0; ox < width; ox++ {
+			// Map to -1..1, push outwards the further from the middle we are, and map back.
+			var (
+				u  = 2*(float64(ox)+0.5)/float64(width) - 1
+				v  = 2*(float64(oy)+0.5)/float64(height) - 1
+				r2 = u*u + v*v
+				k  = 1 + postCurvature*r2
+				su = u * k
+				sv = v * k
+			)
+
+			i := oy*width + ox
+			if math.Abs(su) > 1 || math.Abs(sv) > 1 {
+				p.curve[i] = -1
+				continue
+			}
+
+			sx := int((su + 1) / 2 * float64(width))
+			sy := int((sv + 1) / 2 * float64(height))
+			if sx >= width {
+				sx = width - 1
+			}
+			if sy >= height {
+				sy = height - 1
+			}
+
+			p.curve[i] = int32(p.flat.PixOffset(sx, sy))
+		}
+	}
+}
+
+func clampByte(v int32) uint8 {
+	if v >= 255 {
+		return 255
+	}
+
+	if v <= 0 {
+		return 0
+	}
+
+	return uint8(v)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"image"
+	imagecolor "image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+func TestParsePostEffects(t *testing.T) {
+	tests := []struct {
+		in   string
+		want postEffect
+	}{
+		{"off", 0},
+		{"lcd", effectPixelGrid},
+		{"crt", effectScanlines | effectBloom | effectCurvature},
+		{"scanlines, grid", effectScanlines | effectPixelGrid},
+	}
+
+	for _, test := range tests {
+		got, err := parsePostEffects(test.in)
+		if err != nil {
+			t.Fatalf("%q: %s", test.in, err)
+		}
+
+		if got != test.want {
+			t.Errorf("%q: got %s, want %s", test.in, got, test.want)
+		}
+	}
+
+	if _, err := parsePostEffects("sepia"); err == nil {
+		t.Error("expected an error for an unknown effect")
+	}
+}
+
+func TestPostEffectsCycle(t *testing.T) {
+	effects := postEffect(0)
+	for range postEffectPresets {
+		effects = effects.next()
+	}
+
+	if effects != 0 {
+		t.Errorf("cycling through every preset ended up at %s", effects)
+	}
+}
+
+// flatFrame returns a frame of the default screen size filled with c.
+func flatFrame(c color) *image.RGBA {
+	frame := image.NewRGBA(image.Rect(0, 0, int(defaultScreenSize.width), int(defaultScreenSize.height)))
+	draw.Draw(frame, frame.Rect, image.NewUniform(c.rgba()), image.Point{}, draw.Src)
+
+	return frame
+}
+
+// within returns whether got is within 2 of want, to allow for the levels being rounded.
+func within(got uint8, want float64) bool {
+	return math.Abs(float64(got)-want) <= 2
+}
+
+func TestPostProcessScanlines(t *testing.T) {
+	var (
+		grey = color{200, 200, 200}
+		out  = newPostProcessor(effectScanlines, defaultScreenSize).process(flatFrame(grey))
+	)
+
+	for _, block := range []image.Point{{0, 0}, {17, 42}, {319, 239}} {
+		for dy := 0; dy < postProcessScale; dy++ {
+			for dx := 0; dx < postProcessScale; dx++ {
+				want := 200.0
+				if dy == postProcessScale-1 {
+					want *= postScanlineLevel
+				}
+
+				if got := out.RGBAAt(block.X*postProcessScale+dx, block.Y*postProcessScale+dy); !within(got.R, want) || got.A != 0xff {
+					t.Errorf("block %v: got %v at %d,%d; want %.0f", block, got, dx, dy, want)
+				}
+			}
+		}
+	}
+}
+
+func TestPostProcessPixelGrid(t *testing.T) {
+	var (
+		grey = color{200, 200, 200}
+		out  = newPostProcessor(effectPixelGrid, defaultScreenSize).process(flatFrame(grey))
+	)
+
+	for _, block := range []image.Point{{0, 0}, {17, 42}, {319, 239}} {
+		for dy := 0; dy < postProcessScale-1; dy++ {
+			for dx := 0; dx < postProcessScale; dx++ {
+				want := 200.0
+				if dx == postProcessScale-1 {
+					want *= postGridLevel
+				}
+
+				if got := out.RGBAAt(block.X*postProcessScale+dx, block.Y*postProcessScale+dy); !within(got.R, want) {
+					t.Errorf("block %v: got %v at %d,%d; want %.0f", block, got, dx, dy, want)
+				}
+			}
+		}
+	}
+}
+
+func TestPostProcessCurvature(t *testing.T) {
+	var (
+		grey   = color{200, 200, 200}
+		out    = newPostProcessor(effectCurvature, defaultScreenSize).process(flatFrame(grey))
+		bounds = out.Bounds()
+		black  = imagecolor.RGBA{0, 0, 0, 0xff}
+	)
+
+	for _, corner := range []image.Point{
+		{bounds.Min.X, bounds.Min.Y},
+		{bounds.Max.X - 1, bounds.Min.Y},
+		{bounds.Min.X, bounds.Max.Y - 1},
+		{bounds.Max.X - 1, bounds.Max.Y - 1},
+	} {
+		if got := out.RGBAAt(corner.X, corner.Y); got != black {
+			t.Errorf("got %v in the corner at %v", got, corner)
+		}
+	}
+
+	if got := out.RGBAAt(bounds.Dx()/2, bounds.Dy()/2); got != grey.rgba() {
+		t.Errorf("got %v in the middle; want %v", got, grey.rgba())
+	}
+}
+
+func TestPostProcessBloom(t *testing.T) {
+	var (
+		dark   = color{0x10, 0x10, 0x10}
+		frame  = flatFrame(dark)
+		bright = image.Pt(160, 120)
+	)
+
+	frame.SetRGBA(bright.X, bright.Y, imagecolor.RGBA{0xff, 0xff, 0xff, 0xff})
+
+	out := newPostProcessor(effectBloom, defaultScreenSize).process(frame)
+
+	at := func(p image.Point) imagecolor.RGBA {
+		return out.RGBAAt(p.X*postProcessScale, p.Y*postProcessScale)
+	}
+
+	for _, neighbour := range []image.Point{bright.Add(image.Pt(1, 0)), bright.Add(image.Pt(0, -1)), bright.Add(image.Pt(-2, 2))} {
+		if got := at(neighbour); got.R <= dark.r {
+			t.Errorf("got %v next to the bright pixel at %v; want it brighter than %v", got, neighbour, dark)
+		}
+	}
+
+	if got := at(image.Pt(10, 10)); got != dark.rgba() {
+		t.Errorf("got %v far from the bright pixel; want %v", got, dark.rgba())
+	}
+}
+
+func BenchmarkPostProcess(b *testing.B) {
+	var (
+		p     = newPostProcessor(effectScanlines|effectBloom|effectCurvature, defaultScreenSize)
+		frame = image.NewRGBA(image.Rect(0, 0, int(defaultScreenSize.width), int(defaultScreenSize.height)))
+	)
+
+	for i := range frame.Pix {
+		frame.Pix[i] = byte(i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		p.process(frame)
+	}
+}
@@ -1,112 +1,330 @@
 package main
 
 import (
-	"math"
+	"fmt"
+	"image"
+	"io"
+	"time"
 
 	"github.com/pkg/errors"
-	"github.com/veandco/go-sdl2/sdl"
 )
 
+// renderBackend is something the m8's screen can be drawn to.
+//
+// All coordinates are in the m8's screen space.
+type renderBackend interface {
+	// fillRect fills the rectangle at pos with the given color.
+	fillRect(pos position, size size, c color) error
+
+	// drawGlyph draws the foreground pixels of ch's glyph in f with its top left corner at pos.
+	drawGlyph(f *font, ch byte, pos position, c color) error
+
+	// drawPoints draws a single pixel at each point.
+	drawPoints(points []position, c color) error
+
+	// present shows everything drawn so far.
+	present() error
+
+	// snapshot returns a copy of what's been drawn so far, at the m8's resolution.
+	snapshot() (*image.RGBA, error)
+
+	// resize changes the size of the m8's screen, clearing it.
+	resize(screen size) error
+}
+
 type renderer struct {
-	window   *sdl.Window
-	renderer *sdl.Renderer
-	font     *sdl.Texture
+	backend       renderBackend
+	screenshotter *screenshotter
+	videoRecorder *videoRecorder
+
+	// screen is the size of the m8's screen.
+	screen size
+
+	// fonts are the fonts for each of the m8's font modes, and font is the one for fontMode, which is in use.
+	fonts    [fontModeCount]*font
+	fontMode fontMode
+	font     *font
+
+	// overlays are drawn over the m8's screen, and overlaysShown is which of them were showing last frame.
+	status        statusOverlay
+	joypad        joypadOverlay
+	overlays      []overlay
+	overlaysShown []bool
+
+	// themes remaps the m8's colors as they're drawn. Commands, the text grid and bgColor all keep the m8's own
+	// colors, so whatever they decide from them doesn't depend on the theme.
+	themes *themeSet
+
+	dirty   bool
+	bgColor color
+
+	// text is the text on the m8's screen, which is written to textDump whenever it changes if textDump is set.
+	text     textGrid
+	textDump io.Writer
 
-	dirty    bool
-	bgColor  color
-	waveform [m8ScreenWidth]sdl.Point
+	// waveform is reused by every DrawOscWaveformCmd.
+	waveform []position
 }
 
-// newRenderer creates a new renderer instance with a window size of width & height.
-//
-// The logical size is fixed to be the actual dimensions of the m8's screen.
-func newRenderer(width, height int32) (*renderer, error) {
-	if err := sdl.Init(sdl.INIT_EVERYTHING); err != nil {
-		return nil, errors.Wrap(err, "error initializing sdl")
+func newRenderer(backend renderBackend) *renderer {
+	r := renderer{
+		backend: backend,
+		screen:  defaultScreenSize,
+		fonts:   [fontModeCount]*font{defaultFont, defaultFont},
+		font:    defaultFont,
 	}
 
-	window, err := sdl.CreateWindow(
-		"M8",
-		sdl.WINDOWPOS_CENTERED, sdl.WINDOWPOS_CENTERED,
-		width, height,
-		sdl.WINDOW_SHOWN | sdl.WINDOW_FULLSCREEN,
-	)
-	if err != nil {
-		return nil, errors.Wrap(err, "error creating window")
+	r.overlays = []overlay{&r.status, &r.joypad}
+	r.overlaysShown = make([]bool, len(r.overlays))
+	r.text.resize(r.screen, textCellSize(r.font))
+
+	return &r
+}
+
+// setScreenSize changes the size of the m8's screen.
+func (r *renderer) setScreenSize(screen size) error {
+	if screen == r.screen {
+		return nil
 	}
 
-	sdlRenderer, err := sdl.CreateRenderer(window, -1, sdl.RENDERER_SOFTWARE)
-	if err != nil {
-		return nil, errors.Wrap(err, "error creating renderer")
+	if err := r.backend.resize(screen); err != nil {
+		return errors.Wrapf(err, "error resizing screen to %dx%d", screen.width, screen.height)
 	}
 
-	if err := sdlRenderer.SetLogicalSize(m8ScreenWidth, m8ScreenHeight); err != nil {
-		return nil, errors.Wrap(err, "error setting renderer logical size")
+	r.screen = screen
+	r.text.resize(screen, textCellSize(r.font))
+	r.dirty = true
+
+	return nil
+}
+
+// showSystemInfo shows what the m8 has reported about itself in the window's title and the status overlay.
+func (r *renderer) showSystemInfo(info SystemInfoCmd) {
+	if backend, ok := r.backend.(windowedBackend); ok {
+		backend.setTitle(fmt.Sprintf("M8 - %s (firmware %s)", info.model, info.firmware))
 	}
 
-	font, err := createFont(sdlRenderer)
-	if err != nil {
-		return nil, errors.Wrap(err, "error initializing font for renderer")
+	r.status.show(info, r.screen)
+	r.dirty = true
+}
+
+// toggleStatus pins the status overlay so it stays showing, or unpins it.
+func (r *renderer) toggleStatus() {
+	r.status.pinned = !r.status.pinned
+	r.status.until = time.Time{}
+	r.dirty = true
+}
+
+// toggleJoypad shows or hides the joypad overlay.
+func (r *renderer) toggleJoypad() {
+	r.joypad.enabled = !r.joypad.enabled
+	r.dirty = true
+}
+
+// setJoypadKeys updates the keys shown as pressed in the joypad overlay: remote is what the m8 reports is pressed on
+// it, and local is what's been pressed here.
+func (r *renderer) setJoypadKeys(remote, local uint8) {
+	if remote == r.joypad.remote && local == r.joypad.local {
+		return
 	}
 
-	return &renderer{
-		window,
-		sdlRenderer,
-		font,
-		false,
-		color{},
-		[m8ScreenWidth]sdl.Point{},
-	}, nil
+	r.joypad.remote, r.joypad.local = remote, local
+
+	if r.joypad.enabled {
+		r.dirty = true
+	}
 }
 
-func (r *renderer) toggleFullscreen() {
-	// TODO: impl
-	panic("not implemented")
+// updateOverlays marks the renderer dirty if any overlay has come or gone since the last frame.
+func (r *renderer) updateOverlays(now time.Time) {
+	for i, overlay := range r.overlays {
+		if overlay.visible(now) != r.overlaysShown[i] {
+			r.dirty = true
+		}
+	}
 }
 
-func (r *renderer) render() error {
-	if !r.dirty {
+// drawOverlays redraws the overlays showing at now.
+func (r *renderer) drawOverlays(now time.Time) error {
+	backend, ok := r.backend.(overlayBackend)
+	if !ok {
 		return nil
 	}
 
-	r.renderer.Present()
-	r.dirty = false
+	var (
+		shown   []overlay
+		changed bool
+	)
+
+	for i, overlay := range r.overlays {
+		visible := overlay.visible(now)
+		if visible {
+			shown = append(shown, overlay)
+		}
+
+		changed = changed || visible || r.overlaysShown[i]
+		r.overlaysShown[i] = visible
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if len(shown) == 0 {
+		return backend.drawOverlay(nil)
+	}
+
+	return backend.drawOverlay(func() error {
+		for _, overlay := range shown {
+			if err := overlay.draw(r); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// setFont sets the font to use for the given font mode.
+func (r *renderer) setFont(mode fontMode, f *font) {
+	r.fonts[mode] = f
+
+	if mode == r.fontMode {
+		r.font = f
+	}
+
+	r.text.resize(r.screen, textCellSize(r.font))
+}
+
+// setFontMode switches to the font for the m8's font mode.
+func (r *renderer) setFontMode(mode fontMode) {
+	r.fontMode = mode
+	r.font = r.fonts[mode]
+	r.text.resize(r.screen, textCellSize(r.font))
+}
+
+// requestScreenshot asks for the next frame rendered to be saved as a screenshot.
+func (r *renderer) requestScreenshot() {
+	if r.screenshotter == nil {
+		return
+	}
+
+	r.screenshotter.request()
+
+	// Render a frame to take it from even if the m8 has nothing new to draw.
+	r.dirty = true
+}
+
+// windowedBackend is a renderBackend with a window.
+type windowedBackend interface {
+	toggleFullscreen() error
+	windowChanged() error
+	setTitle(title string)
+
+	// setBackground is called when the m8 clears its screen, so the window's border can match it.
+	setBackground(c color) error
+}
+
+// themed returns the color to draw the m8's color c in.
+func (r *renderer) themed(c color) color {
+	if r.themes == nil {
+		return c
+	}
+
+	return r.themes.remap(c)
+}
+
+// setBackground records the color the m8 last cleared its screen with.
+func (r *renderer) setBackground(c color) error {
+	r.bgColor = c
+
+	if backend, ok := r.backend.(windowedBackend); ok {
+		return backend.setBackground(r.themed(c))
+	}
+
+	return nil
+}
+
+func (r *renderer) toggleFullscreen() error {
+	if backend, ok := r.backend.(windowedBackend); ok {
+		return backend.toggleFullscreen()
+	}
+
+	return nil
+}
+
+// windowChanged is called when the window's been moved or resized.
+func (r *renderer) windowChanged() error {
+	if backend, ok := r.backend.(windowedBackend); ok {
+		return backend.windowChanged()
+	}
 
 	return nil
 }
 
-func createFont(renderer *sdl.Renderer) (*sdl.Texture, error) {
-	surface, err := sdl.CreateRGBSurfaceWithFormat(0, fontWidth, fontHeight, 32, sdl.PIXELFORMAT_ARGB8888)
-	if err != nil {
-		return nil, errors.Wrap(err, "error creating surface for font")
+// postProcessedBackend is a renderBackend that can apply post-processing effects to what it presents.
+type postProcessedBackend interface {
+	effects() postEffect
+	setEffects(effects postEffect)
+}
+
+// cycleEffects switches to the next preset of post-processing effects and returns it.
+func (r *renderer) cycleEffects() postEffect {
+	backend, ok := r.backend.(postProcessedBackend)
+	if !ok {
+		return 0
 	}
-	defer surface.Free()
 
+	effects := backend.effects().next()
+	backend.setEffects(effects)
+
+	// Show the change even if the m8 has nothing new to draw.
+	r.dirty = true
+
+	return effects
+}
+
+func (r *renderer) render() error {
+	if !r.dirty {
+		return nil
+	}
+
+	// Grab the frame before presenting it, since what's left behind afterwards is up to the backend.
 	var (
-		pixels = surface.Pixels()
-		cols   = int(surface.W*surface.H) / 8
+		screenshot = r.screenshotter != nil && r.screenshotter.pending()
+		record     = r.videoRecorder != nil
 	)
+	if screenshot || record {
+		frame, err := r.backend.snapshot()
+		if err != nil {
+			return errors.Wrap(err, "error capturing frame")
+		}
 
-	// Map the font data to an 8x8 surface with argb color values.
-	for col := 0; col < cols; col++ {
-		pixel := fontData[col]
-		for row := 0; row < 8; row++ {
-			var color byte
-			if pixel&(1<<row) == 0 {
-				color = math.MaxUint8
-			}
+		if screenshot {
+			r.screenshotter.save(frame)
+		}
 
-			// Set all 4 color components (ARGB)
-			for cmp := 0; cmp < 4; cmp++ {
-				pixels[(col*8+row)*4+cmp] = color
-			}
+		if record {
+			r.videoRecorder.record(time.Now(), frame)
 		}
 	}
 
-	font, err := renderer.CreateTextureFromSurface(surface)
-	if err != nil {
-		return nil, errors.Wrap(err, "error creating texture for font")
+	if r.textDump != nil && r.text.changed {
+		if err := r.text.dump(r.textDump, r.bgColor); err != nil {
+			return errors.Wrap(err, "error dumping text")
+		}
 	}
+	r.text.changed = false
 
-	return font, nil
+	if err := r.drawOverlays(time.Now()); err != nil {
+		return errors.Wrap(err, "error drawing overlays")
+	}
+
+	if err := r.backend.present(); err != nil {
+		return err
+	}
+
+	r.dirty = false
+
+	return nil
 }
@@ -0,0 +1,547 @@
+package main
+
+import (
+	stderrors "errors"
+	"image"
+	"math"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+type sdlWindowConfig struct {
+	// mode is the window mode to start in.
+	mode windowMode
+
+	// fullscreenMode is the mode toggled to from windowed.
+	fullscreenMode windowMode
+
+	// geometry is the window's geometry when windowed.
+	geometry windowGeometry
+
+	// scaleMode is how the m8's screen is scaled to fit the window.
+	scaleMode scaleMode
+
+	// filter is how textures are sampled when they're scaled.
+	filter scaleFilter
+
+	// borderColor is the color of the window around the m8's screen; if nil, it's the m8's background color.
+	borderColor *color
+
+	// accelerated asks for a hardware accelerated renderer.
+	accelerated bool
+
+	// vsync syncs presenting to the display's refresh.
+	vsync bool
+
+	// effects are the post-processing effects to start with.
+	effects postEffect
+}
+
+// sdlRenderBackend draws to an SDL window.
+//
+// Everything the m8 sends is drawn to a texture the size of its screen, which is then scaled up to the window on
+// every present; that way nothing relies on the window's backbuffer surviving between frames.
+type sdlRenderBackend struct {
+	window   *sdl.Window
+	renderer *sdl.Renderer
+	target   *sdl.Texture
+
+	// screen is the size of the m8's screen, and so of the target.
+	screen size
+
+	// overlay is drawn over the target when overlayShown.
+	overlay      *sdl.Texture
+	overlayShown bool
+
+	// fonts holds a texture of each font's atlas, created the first time the font's drawn with.
+	fonts map[*font]*sdl.Texture
+
+	// accelerated is whether the renderer is hardware accelerated.
+	accelerated bool
+
+	mode           windowMode
+	fullscreenMode windowMode
+	geometry       windowGeometry
+
+	scaleMode   scaleMode
+	borderColor *color
+	bgColor     color
+
+	// dest is where the m8's screen goes in the window.
+	dest sdl.Rect
+
+	// post applies post-processing effects on the CPU, so they work with any renderer; the result is uploaded to
+	// postTexture to be shown instead of the target. Both are created the first time effects are turned on.
+	post        *postProcessor
+	postFrame   *image.RGBA
+	postTexture *sdl.Texture
+
+	points []sdl.Point
+}
+
+// newSDLRenderBackend creates a new SDL window to render to.
+func newSDLRenderBackend(cfg sdlWindowConfig) (*sdlRenderBackend, error) {
+	if err := sdl.Init(sdl.INIT_EVERYTHING); err != nil {
+		return nil, errors.Wrap(err, "error initializing sdl")
+	}
+
+	window, err := sdl.CreateWindow(
+		"M8",
+		cfg.geometry.X, cfg.geometry.Y,
+		cfg.geometry.Width, cfg.geometry.Height,
+		sdl.WINDOW_SHOWN|sdl.WINDOW_RESIZABLE|cfg.mode.sdlFlags(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating window")
+	}
+
+	sdlRenderer, accelerated, err := createSDLRenderer(window, cfg.accelerated, cfg.vsync)
+	if err != nil {
+		return nil, err
+	}
+
+	// Textures pick up the hint when they're created, so this has to come first.
+	sdl.SetHint(sdl.HINT_RENDER_SCALE_QUALITY, cfg.filter.String())
+
+	fullscreenMode := cfg.fullscreenMode
+	if cfg.mode != windowModeWindowed {
+		fullscreenMode = cfg.mode
+	}
+
+	b := sdlRenderBackend{
+		window:         window,
+		renderer:       sdlRenderer,
+		fonts:          map[*font]*sdl.Texture{},
+		accelerated:    accelerated,
+		mode:           cfg.mode,
+		fullscreenMode: fullscreenMode,
+		geometry:       cfg.geometry,
+		scaleMode:      cfg.scaleMode,
+		borderColor:    cfg.borderColor,
+	}
+
+	if err := b.resize(defaultScreenSize); err != nil {
+		return nil, err
+	}
+
+	if _, err := b.fontTexture(defaultFont); err != nil {
+		return nil, err
+	}
+
+	b.setEffects(cfg.effects)
+
+	return &b, nil
+}
+
+// createSDLRenderer creates a renderer that can render to textures, falling back to software rendering if
+// there's no accelerated renderer available.
+func createSDLRenderer(window *sdl.Window, accelerated, vsync bool) (*sdl.Renderer, bool, error) {
+	var flags uint32 = sdl.RENDERER_TARGETTEXTURE
+	if vsync {
+		flags |= sdl.RENDERER_PRESENTVSYNC
+	}
+
+	if accelerated {
+		renderer, err := sdl.CreateRenderer(window, -1, flags|sdl.RENDERER_ACCELERATED)
+		if err == nil {
+			return renderer, true, nil
+		}
+	}
+
+	renderer, err := sdl.CreateRenderer(window, -1, flags|sdl.RENDERER_SOFTWARE)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "error creating renderer")
+	}
+
+	return renderer, false, nil
+}
+
+// resize recreates the render target, and everything else sized after the m8's screen, for a screen of the new size.
+func (b *sdlRenderBackend) resize(screen size) error {
+	if err := b.renderer.SetRenderTarget(nil); err != nil {
+		return errors.Wrap(err, "error setting render target")
+	}
+
+	for _, texture := range []*sdl.Texture{b.target, b.overlay, b.postTexture} {
+		if texture != nil {
+			texture.Destroy()
+		}
+	}
+	b.target, b.overlay, b.postTexture = nil, nil, nil
+
+	target, err := b.renderer.CreateTexture(sdl.PIXELFORMAT_RGBA32, sdl.TEXTUREACCESS_TARGET, int32(screen.width), int32(screen.height))
+	if err != nil {
+		return errors.Wrap(err, "error creating render target")
+	}
+	b.target = target
+
+	overlay, err := b.renderer.CreateTexture(sdl.PIXELFORMAT_RGBA32, sdl.TEXTUREACCESS_TARGET, int32(screen.width), int32(screen.height))
+	if err != nil {
+		return errors.Wrap(err, "error creating overlay")
+	}
+	b.overlay, b.overlayShown = overlay, false
+
+	if err := overlay.SetBlendMode(sdl.BLENDMODE_BLEND); err != nil {
+		return errors.Wrap(err, "error setting overlay blend mode")
+	}
+
+	b.screen = screen
+	if b.post != nil {
+		b.post = newPostProcessor(b.post.effects, screen)
+		b.postFrame = image.NewRGBA(image.Rect(0, 0, int(screen.width), int(screen.height)))
+	}
+
+	if err := b.renderer.SetRenderTarget(b.target); err != nil {
+		return errors.Wrap(err, "error setting render target")
+	}
+
+	if err := b.renderer.SetDrawColor(0, 0, 0, math.MaxUint8); err != nil {
+		return err
+	}
+
+	if err := b.renderer.Clear(); err != nil {
+		return err
+	}
+
+	return b.applyScaling()
+}
+
+// applyScaling works out where the m8's screen goes for the window's current size.
+func (b *sdlRenderBackend) applyScaling() error {
+	width, height, err := b.renderer.GetOutputSize()
+	if err != nil {
+		return errors.Wrap(err, "error getting output size")
+	}
+
+	b.dest = scaleScreen(b.scaleMode, b.screen, width, height)
+
+	return nil
+}
+
+// setBackground makes the border around the m8's screen follow its background color.
+func (b *sdlRenderBackend) setBackground(c color) error {
+	b.bgColor = c
+	return nil
+}
+
+func (b *sdlRenderBackend) setTitle(title string) {
+	b.window.SetTitle(title)
+}
+
+// toggleFullscreen switches between windowed and fullscreen.
+func (b *sdlRenderBackend) toggleFullscreen() error {
+	if b.mode == windowModeWindowed {
+		return b.setWindowMode(b.fullscreenMode)
+	}
+
+	return b.setWindowMode(windowModeWindowed)
+}
+
+func (b *sdlRenderBackend) setWindowMode(mode windowMode) error {
+	if mode == b.mode {
+		return nil
+	}
+
+	if err := b.window.SetFullscreen(mode.sdlFlags()); err != nil {
+		return errors.Wrapf(err, "error switching to %s", mode)
+	}
+
+	// Coming back from fullscreen, put the window back where it was.
+	if mode == windowModeWindowed {
+		b.window.SetSize(b.geometry.Width, b.geometry.Height)
+		b.window.SetPosition(b.geometry.X, b.geometry.Y)
+	}
+
+	b.mode = mode
+
+	return nil
+}
+
+// windowChanged keeps track of where the window is when the user moves or resizes it.
+func (b *sdlRenderBackend) windowChanged() error {
+	if b.mode == windowModeWindowed {
+		b.geometry.X, b.geometry.Y = b.window.GetPosition()
+		b.geometry.Width, b.geometry.Height = b.window.GetSize()
+	}
+
+	return b.applyScaling()
+}
+
+// effects returns the post-processing effects being applied.
+func (b *sdlRenderBackend) effects() postEffect {
+	if b.post == nil {
+		return 0
+	}
+
+	return b.post.effects
+}
+
+// setEffects changes the post-processing effects applied when presenting.
+func (b *sdlRenderBackend) setEffects(effects postEffect) {
+	if b.post == nil {
+		if effects == 0 {
+			return
+		}
+
+		b.post = newPostProcessor(effects, b.screen)
+		b.postFrame = image.NewRGBA(image.Rect(0, 0, int(b.screen.width), int(b.screen.height)))
+	}
+
+	b.post.effects = effects
+}
+
+// Close saves the window's geometry for next time and tears everything down, returning every error along the way.
+func (b *sdlRenderBackend) Close() error {
+	errs := []error{saveWindowGeometry(b.geometry)}
+
+	for _, texture := range []*sdl.Texture{b.postTexture, b.overlay, b.target} {
+		if texture != nil {
+			errs = append(errs, texture.Destroy())
+		}
+	}
+
+	for _, texture := range b.fonts {
+		errs = append(errs, texture.Destroy())
+	}
+
+	errs = append(errs, b.renderer.Destroy(), b.window.Destroy())
+
+	return stderrors.Join(errs...)
+}
+
+func (b *sdlRenderBackend) fillRect(pos position, size size, c color) error {
+	if err := b.renderer.SetDrawColor(c.r, c.g, c.b, math.MaxUint8); err != nil {
+		return err
+	}
+
+	return b.renderer.FillRect(&sdl.Rect{
+		X: int32(pos.x),
+		Y: int32(pos.y),
+		W: int32(size.width),
+		H: int32(size.height),
+	})
+}
+
+func (b *sdlRenderBackend) drawGlyph(f *font, ch byte, pos position, c color) error {
+	glyph, ok := f.glyph(ch)
+	if !ok {
+		return nil
+	}
+
+	texture, err := b.fontTexture(f)
+	if err != nil {
+		return err
+	}
+
+	if err := texture.SetColorMod(c.r, c.g, c.b); err != nil {
+		return err
+	}
+
+	var (
+		sourceRect = sdl.Rect{
+			X: int32(glyph.Min.X),
+			Y: int32(glyph.Min.Y),
+			W: int32(glyph.Dx()),
+			H: int32(glyph.Dy()),
+		}
+
+		renderRect = sdl.Rect{
+			X: int32(pos.x),
+			Y: int32(pos.y),
+			W: int32(glyph.Dx()),
+			H: int32(glyph.Dy()),
+		}
+	)
+
+	return b.renderer.Copy(texture, &sourceRect, &renderRect)
+}
+
+func (b *sdlRenderBackend) drawPoints(points []position, c color) error {
+	if err := b.renderer.SetDrawColor(c.r, c.g, c.b, math.MaxUint8); err != nil {
+		return err
+	}
+
+	if cap(b.points) < len(points) {
+		b.points = make([]sdl.Point, len(points))
+	}
+
+	sdlPoints := b.points[:len(points)]
+	for i, point := range points {
+		sdlPoints[i] = sdl.Point{X: int32(point.x), Y: int32(point.y)}
+	}
+
+	return b.renderer.DrawPoints(sdlPoints)
+}
+
+// present scales the m8's screen up to the window.
+func (b *sdlRenderBackend) present() error {
+	screen := b.target
+	if b.effects() != 0 {
+		var err error
+		if screen, err = b.postProcess(); err != nil {
+			return err
+		}
+	}
+
+	if err := b.renderer.SetRenderTarget(nil); err != nil {
+		return errors.Wrap(err, "error setting render target")
+	}
+
+	border := b.bgColor
+	if b.borderColor != nil {
+		border = *b.borderColor
+	}
+
+	if err := b.renderer.SetDrawColor(border.r, border.g, border.b, math.MaxUint8); err != nil {
+		return err
+	}
+
+	if err := b.renderer.Clear(); err != nil {
+		return err
+	}
+
+	if err := b.renderer.Copy(screen, nil, &b.dest); err != nil {
+		return errors.Wrap(err, "error copying screen to window")
+	}
+
+	if b.overlayShown {
+		if err := b.renderer.Copy(b.overlay, nil, &b.dest); err != nil {
+			return errors.Wrap(err, "error copying overlay to window")
+		}
+	}
+
+	b.renderer.Present()
+
+	if err := b.renderer.SetRenderTarget(b.target); err != nil {
+		return errors.Wrap(err, "error setting render target")
+	}
+
+	return nil
+}
+
+// drawOverlay clears the overlay and redirects drawing to it while draw runs.
+func (b *sdlRenderBackend) drawOverlay(draw func() error) error {
+	if err := b.renderer.SetRenderTarget(b.overlay); err != nil {
+		return errors.Wrap(err, "error setting render target")
+	}
+
+	if err := b.renderer.SetDrawColor(0, 0, 0, 0); err != nil {
+		return err
+	}
+
+	if err := b.renderer.Clear(); err != nil {
+		return err
+	}
+
+	var err error
+	if draw != nil {
+		err = draw()
+	}
+
+	b.overlayShown = draw != nil
+
+	if err := b.renderer.SetRenderTarget(b.target); err != nil {
+		return errors.Wrap(err, "error setting render target")
+	}
+
+	return err
+}
+
+// postProcess reads back the render target, applies the post-processing effects to it and returns a texture of the
+// result.
+func (b *sdlRenderBackend) postProcess() (*sdl.Texture, error) {
+	if err := b.readPixels(b.postFrame); err != nil {
+		return nil, err
+	}
+
+	frame := b.post.process(b.postFrame)
+
+	if b.postTexture == nil {
+		texture, err := b.renderer.CreateTexture(sdl.PIXELFORMAT_RGBA32, sdl.TEXTUREACCESS_STREAMING, int32(frame.Rect.Dx()), int32(frame.Rect.Dy()))
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating post-processing texture")
+		}
+
+		b.postTexture = texture
+	}
+
+	if err := b.postTexture.Update(nil, unsafe.Pointer(&frame.Pix[0]), frame.Stride); err != nil {
+		return nil, errors.Wrap(err, "error updating post-processing texture")
+	}
+
+	return b.postTexture, nil
+}
+
+// snapshot reads back the render target.
+func (b *sdlRenderBackend) snapshot() (*image.RGBA, error) {
+	frame := image.NewRGBA(image.Rect(0, 0, int(b.screen.width), int(b.screen.height)))
+	if err := b.readPixels(frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+func (b *sdlRenderBackend) readPixels(frame *image.RGBA) error {
+	if err := b.renderer.ReadPixels(nil, sdl.PIXELFORMAT_RGBA32, unsafe.Pointer(&frame.Pix[0]), frame.Stride); err != nil {
+		return errors.Wrap(err, "error reading pixels")
+	}
+
+	return nil
+}
+
+// fontTexture returns the texture of f's atlas, creating it if need be.
+func (b *sdlRenderBackend) fontTexture(f *font) (*sdl.Texture, error) {
+	if texture, ok := b.fonts[f]; ok {
+		return texture, nil
+	}
+
+	texture, err := createFont(b.renderer, f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error initializing font %s for renderer", f.name)
+	}
+
+	b.fonts[f] = texture
+
+	return texture, nil
+}
+
+func createFont(renderer *sdl.Renderer, f *font) (*sdl.Texture, error) {
+	var (
+		width  = f.atlas.Rect.Dx()
+		height = f.atlas.Rect.Dy()
+	)
+
+	surface, err := sdl.CreateRGBSurfaceWithFormat(0, int32(width), int32(height), 32, sdl.PIXELFORMAT_ARGB8888)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating surface for font")
+	}
+	defer surface.Free()
+
+	pixels := surface.Pixels()
+
+	// Map the atlas to a surface with argb color values: set pixels are opaque white and the rest transparent.
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var color byte
+			if f.atlas.AlphaAt(x, y).A != 0 {
+				color = math.MaxUint8
+			}
+
+			// Set all 4 color components (ARGB)
+			offset := y*int(surface.Pitch) + x*4
+			for cmp := 0; cmp < 4; cmp++ {
+				pixels[offset+cmp] = color
+			}
+		}
+	}
+
+	font, err := renderer.CreateTextureFromSurface(surface)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating texture for font")
+	}
+
+	return font, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// frameSchedulerQueueLen is how many batches of commands can be waiting to be applied.
+const frameSchedulerQueueLen = 8
+
+// cmdBatch is a batch of commands, along with the storage the ones decoded into it live in.
+//
+// Putting a command in a cmd allocates a copy of it, unless it's a pointer; so that decoding doesn't allocate a
+// command at a time, the commands the m8 sends all the time are decoded into the batch's storage and handed around as
+// pointers to it. Batches are reused once they've been applied, so the commands in one are only valid until then.
+type cmdBatch struct {
+	cmds []cmd
+
+	rects     []DrawRectCmd
+	chars     []DrawCharCmd
+	waveforms []DrawOscWaveformCmd
+
+	// waveformData holds the waveforms' data, copied out of the packets they came in.
+	waveformData []byte
+}
+
+// reset empties the batch, keeping its storage.
+func (b *cmdBatch) reset() {
+	b.cmds = b.cmds[:0]
+	b.rects = b.rects[:0]
+	b.chars = b.chars[:0]
+	b.waveforms = b.waveforms[:0]
+	b.waveformData = b.waveformData[:0]
+}
+
+// add adds cmd to the batch.
+func (b *cmdBatch) add(cmd cmd) {
+	b.cmds = append(b.cmds, cmd)
+}
+
+// addRect, addChar and addWaveform add a copy of the command kept in the batch's storage.
+//
+// Growing the storage leaves commands already added pointing at the old storage, which is fine since they're never
+// changed.
+func (b *cmdBatch) addRect(c DrawRectCmd) {
+	b.rects = append(b.rects, c)
+	b.add(&b.rects[len(b.rects)-1])
+}
+
+func (b *cmdBatch) addChar(c DrawCharCmd) {
+	b.chars = append(b.chars, c)
+	b.add(&b.chars[len(b.chars)-1])
+}
+
+// addWaveform also copies waveform, which is only valid until the next packets are decoded, into the batch's storage.
+func (b *cmdBatch) addWaveform(c DrawOscWaveformCmd, waveform []byte) {
+	if len(waveform) > 0 {
+		start := len(b.waveformData)
+		b.waveformData = append(b.waveformData, waveform...)
+		c.waveform = b.waveformData[start:len(b.waveformData):len(b.waveformData)]
+	}
+
+	b.waveforms = append(b.waveforms, c)
+	b.add(&b.waveforms[len(b.waveforms)-1])
+}
+
+// frameStats counts what the frame scheduler has done since the stats were last reset.
+type frameStats struct {
+	frames  uint64
+	cmds    uint64
+	dropped uint64
+
+	// maxCmds is the most commands applied in a single frame.
+	maxCmds int
+}
+
+// frameScheduler decouples processing commands from presenting frames.
+//
+// The SLIP processing goroutine hands batches of commands over with submit; they're applied as soon as the
+// renderer's goroutine gets to them, but frames are only presented once per interval (or, with an interval of 0, as
+// fast as vsync allows).
+//
+// Everything that touches the renderer happens on the goroutine calling apply and tick, which should be the main
+// thread, since that's where SDL wants to be called from.
+type frameScheduler struct {
+	logger   *log.Logger
+	renderer *renderer
+	execute  func(cmd) error
+	interval time.Duration
+
+	// batches are waiting to be applied and free are done with, ready to be reused.
+	batches chan *cmdBatch
+	free    chan *cmdBatch
+
+	stats       frameStats
+	pendingCmds int
+	lastTick    time.Time
+}
+
+func newFrameScheduler(logger *log.Logger, renderer *renderer, execute func(cmd) error, fps int) *frameScheduler {
+	s := frameScheduler{
+		logger:   logger,
+		renderer: renderer,
+		execute:  execute,
+		batches:  make(chan *cmdBatch, frameSchedulerQueueLen),
+		free:     make(chan *cmdBatch, frameSchedulerQueueLen),
+	}
+
+	if fps > 0 {
+		s.interval = time.Second / time.Duration(fps)
+	}
+
+	for i := 0; i < frameSchedulerQueueLen; i++ {
+		s.free <- &cmdBatch{}
+	}
+
+	return &s
+}
+
+// batch returns an empty batch to fill and submit, waiting for one to be free if they're all queued.
+func (s *frameScheduler) batch() *cmdBatch {
+	batch := <-s.free
+	batch.reset()
+
+	return batch
+}
+
+// submit queues a batch, got from batch, to be applied.
+func (s *frameScheduler) submit(batch *cmdBatch) {
+	s.batches <- batch
+}
+
+// submitCmds queues cmds to be applied.
+func (s *frameScheduler) submitCmds(cmds ...cmd) {
+	batch := s.batch()
+	for _, cmd := range cmds {
+		batch.add(cmd)
+	}
+
+	s.submit(batch)
+}
+
+// apply executes a batch of commands received from batches.
+func (s *frameScheduler) apply(batch *cmdBatch) error {
+	defer func() {
+		s.free <- batch
+	}()
+
+	for _, cmd := range batch.cmds {
+		if err := s.execute(cmd); err != nil {
+			return err
+		}
+	}
+
+	s.pendingCmds += len(batch.cmds)
+
+	if s.interval == 0 {
+		return s.present()
+	}
+
+	return nil
+}
+
+// tick presents a frame if anything's changed since the last one.
+func (s *frameScheduler) tick(now time.Time) error {
+	// Tickers drop ticks that aren't received in time; if we've missed any, so have the frames they'd have
+	// presented.
+	if !s.lastTick.IsZero() && s.interval > 0 {
+		if elapsed := now.Sub(s.lastTick); elapsed > s.interval*3/2 {
+			s.stats.dropped += uint64(elapsed/s.interval) - 1
+		}
+	}
+
+	s.lastTick = now
+
+	return s.present()
+}
+
+func (s *frameScheduler) present() error {
+	s.renderer.updateOverlays(time.Now())
+
+	if !s.renderer.dirty {
+		return nil
+	}
+
+	if err := s.renderer.render(); err != nil {
+		return err
+	}
+
+	s.stats.frames++
+	s.stats.cmds += uint64(s.pendingCmds)
+	if s.pendingCmds > s.stats.maxCmds {
+		s.stats.maxCmds = s.pendingCmds
+	}
+
+	s.pendingCmds = 0
+
+	return nil
+}
+
+// logStats logs and resets the stats gathered over the last period.
+func (s *frameScheduler) logStats(period time.Duration) {
+	var (
+		stats        = s.stats
+		cmdsPerFrame float64
+	)
+
+	if stats.frames > 0 {
+		cmdsPerFrame = float64(stats.cmds) / float64(stats.frames)
+	}
+
+	s.logger.Printf("frames: %.1f/s; commands/frame: %.1f (max %d); dropped frames: %d\n", float64(stats.frames)/period.Seconds(), cmdsPerFrame, stats.maxCmds, stats.dropped)
+
+	s.stats = frameStats{}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+// newTestScheduler returns a frame scheduler drawing to a framebuffer at fps, with nothing yet to present.
+func newTestScheduler(fps int) *frameScheduler {
+	ctrl := &controller{
+		logger:   log.New(io.Discard, "", 0),
+		renderer: newRenderer(newFramebufferRenderBackend()),
+	}
+
+	ctrl.renderer.dirty = false
+
+	return newFrameScheduler(ctrl.logger, ctrl.renderer, ctrl.executeCmd, fps)
+}
+
+// rectBatch returns a batch from s with a rect in it.
+func rectBatch(s *frameScheduler) *cmdBatch {
+	batch := s.batch()
+	batch.addRect(DrawRectCmd{pos: position{10, 10}, size: size{20, 20}, color: color{0xff, 0, 0}})
+
+	return batch
+}
+
+func TestFrameSchedulerPresentsOnTick(t *testing.T) {
+	var (
+		s   = newTestScheduler(60)
+		now = time.Now()
+	)
+
+	if err := s.apply(rectBatch(s)); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.stats.frames != 0 {
+		t.Fatalf("got %d frames presented before the tick", s.stats.frames)
+	}
+
+	if err := s.tick(now); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.stats.frames != 1 || s.stats.cmds != 1 {
+		t.Fatalf("got %d frames of %d commands on the tick, want 1 of 1", s.stats.frames, s.stats.cmds)
+	}
+
+	// Nothing's changed since.
+	if err := s.tick(now.Add(s.interval)); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.stats.frames != 1 {
+		t.Fatalf("got %d frames with nothing new to present", s.stats.frames)
+	}
+}
+
+func TestFrameSchedulerWithoutInterval(t *testing.T) {
+	s := newTestScheduler(0)
+
+	if err := s.apply(rectBatch(s)); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.stats.frames != 1 {
+		t.Fatalf("got %d frames presented on applying, want 1", s.stats.frames)
+	}
+}
+
+func TestFrameSchedulerCountsDroppedFrames(t *testing.T) {
+	var (
+		s   = newTestScheduler(60)
+		now = time.Now()
+	)
+
+	for _, tick := range []struct {
+		after   time.Duration
+		dropped uint64
+	}{
+		{0, 0},
+		{s.interval, 0},
+
+		// Late, but not by enough to have missed a tick.
+		{s.interval * 7 / 5, 0},
+
+		// Four ticks missed.
+		{s.interval * 5, 4},
+	} {
+		now = now.Add(tick.after)
+		if err := s.tick(now); err != nil {
+			t.Fatal(err)
+		}
+
+		if s.stats.dropped != tick.dropped {
+			t.Fatalf("got %d dropped frames after a tick %s later, want %d", s.stats.dropped, tick.after, tick.dropped)
+		}
+	}
+}
+
+func TestFrameSchedulerReusesBatches(t *testing.T) {
+	s := newTestScheduler(60)
+
+	batch := rectBatch(s)
+	if len(s.free) != frameSchedulerQueueLen-1 {
+		t.Fatalf("got %d free batches with one taken", len(s.free))
+	}
+
+	s.submit(batch)
+	if err := s.apply(<-s.batches); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.free) != frameSchedulerQueueLen {
+		t.Fatalf("got %d free batches once applied, want %d", len(s.free), frameSchedulerQueueLen)
+	}
+
+	// Batches come back empty.
+	for i := 0; i < frameSchedulerQueueLen; i++ {
+		if batch := s.batch(); len(batch.cmds) != 0 || len(batch.rects) != 0 {
+			t.Fatalf("got a batch of %d commands", len(batch.cmds))
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// screenshotter saves the m8's screen to PNGs on request.
+//
+// Frames are grabbed by the renderer and handed off to a goroutine to encode, so taking a screenshot doesn't hold
+// up processing commands.
+type screenshotter struct {
+	logger *log.Logger
+
+	// dir is where screenshots are saved.
+	dir string
+
+	// scale is how much to upscale screenshots by; if it's more than 1, an upscaled copy is saved alongside the
+	// native resolution one.
+	scale int
+
+	requested atomic.Bool
+	frames    chan *image.RGBA
+}
+
+func newScreenshotter(logger *log.Logger, dir string, scale int) *screenshotter {
+	s := screenshotter{
+		logger: logger,
+		dir:    dir,
+		scale:  scale,
+		frames: make(chan *image.RGBA, 4),
+	}
+
+	go s.run()
+
+	return &s
+}
+
+// request asks for the next frame rendered to be saved.
+func (s *screenshotter) request() {
+	s.requested.Store(true)
+}
+
+// pending returns whether a screenshot has been requested and not yet taken.
+func (s *screenshotter) pending() bool {
+	return s.requested.Load()
+}
+
+// save hands frame off to be saved.
+func (s *screenshotter) save(frame *image.RGBA) {
+	s.requested.Store(false)
+
+	select {
+	case s.frames <- frame:
+	default:
+		s.logger.Println("too many screenshots in flight; dropping screenshot")
+	}
+}
+
+func (s *screenshotter) run() {
+	for frame := range s.frames {
+		paths, err := saveScreenshot(s.dir, time.Now(), frame, s.scale)
+		if err != nil {
+			s.logger.Printf("error saving screenshot: %s\n", err)
+			continue
+		}
+
+		for _, path := range paths {
+			s.logger.Printf("saved screenshot %s\n", path)
+		}
+	}
+}
+
+// saveScreenshot writes frame to a PNG in dir named after at, along with a copy upscaled by scale if it's more
+// than 1.
+func saveScreenshot(dir string, at time.Time, frame *image.RGBA, scale int) ([]string, error) {
+	name := "m8-" + at.Format("20060102-150405.000")
+
+	paths := []string{filepath.Join(dir, name+".png")}
+	if err := writePNG(paths[0], frame); err != nil {
+		return nil, err
+	}
+
+	if scale > 1 {
+		path := filepath.Join(dir, fmt.Sprintf("%s@%dx.png", name, scale))
+		if err := writePNG(path, upscale(frame, scale)); err != nil {
+			return paths, err
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+func writePNG(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "error creating file")
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, img); err != nil {
+		return errors.Wrapf(err, "error encoding %s", path)
+	}
+
+	return file.Close()
+}
+
+// upscale returns a copy of src scaled up by an integer factor, with each pixel becoming a scale x scale block.
+func upscale(src *image.RGBA, scale int) *image.RGBA {
+	var (
+		bounds = src.Bounds()
+		dst    = image.NewRGBA(image.Rect(0, 0, bounds.Dx()*scale, bounds.Dy()*scale))
+	)
+
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			block := image.Rect(x*scale, y*scale, (x+1)*scale, (y+1)*scale)
+			draw.Draw(dst, block, image.NewUniform(src.RGBAAt(bounds.Min.X+x, bounds.Min.Y+y)), image.Point{}, draw.Src)
+		}
+	}
+
+	return dst
+}
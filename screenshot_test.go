@@ -0,0 +1,109 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScreenshotOfStaticScreen(t *testing.T) {
+	var (
+		renderer = newRenderer(newFramebufferRenderBackend())
+		frames   = make(chan *image.RGBA, 1)
+	)
+
+	renderer.screenshotter = &screenshotter{logger: log.New(io.Discard, "", 0), frames: frames}
+
+	// Nothing new to draw.
+	renderer.dirty = false
+
+	renderer.requestScreenshot()
+	if err := renderer.render(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case frame := <-frames:
+		if got := frame.Bounds().Size(); got != image.Pt(int(defaultScreenSize.width), int(defaultScreenSize.height)) {
+			t.Errorf("got frame of %v", got)
+		}
+	default:
+		t.Fatal("expected a frame to be handed off")
+	}
+
+	if renderer.screenshotter.pending() {
+		t.Error("expected the screenshot to have been taken")
+	}
+}
+
+func TestSaveScreenshot(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		at    = time.Date(2024, 3, 9, 14, 5, 7, 250*int(time.Millisecond), time.Local)
+		frame = image.NewRGBA(image.Rect(0, 0, 320, 240))
+	)
+
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 320; x++ {
+			frame.Pix[frame.PixOffset(x, y)] = byte(x)
+			frame.Pix[frame.PixOffset(x, y)+1] = byte(y)
+			frame.Pix[frame.PixOffset(x, y)+3] = 0xff
+		}
+	}
+
+	paths, err := saveScreenshot(dir, at, frame, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		filepath.Join(dir, "m8-20240309-140507.250.png"),
+		filepath.Join(dir, "m8-20240309-140507.250@2x.png"),
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got paths %v, want %v", paths, want)
+	}
+
+	file, err := os.Open(paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := img.Bounds().Size(); got != image.Pt(640, 480) {
+		t.Fatalf("got upscaled size %v", got)
+	}
+
+	// Every pixel becomes a 2x2 block.
+	for y := 0; y < 480; y++ {
+		for x := 0; x < 640; x++ {
+			if got, want := img.At(x, y), frame.At(x/2, y/2); got != want {
+				t.Fatalf("got %v at %d,%d; want %v", got, x, y, want)
+			}
+		}
+	}
+}
+
+func TestSaveScreenshotWithoutScale(t *testing.T) {
+	dir := t.TempDir()
+
+	paths, err := saveScreenshot(dir, time.Date(2024, 3, 9, 14, 5, 7, 0, time.Local), image.NewRGBA(image.Rect(0, 0, 320, 240)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{filepath.Join(dir, "m8-20240309-140507.000.png")}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got paths %v, want %v", paths, want)
+	}
+}
@@ -3,9 +3,9 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"strings"
-	"io"
 
 	"github.com/pkg/errors"
 )
@@ -15,138 +15,343 @@ const slipEsc = 0xDB
 const slipEscEnd = 0xDC
 const slipEscEsc = 0xDD
 
+// slipMaxPacketLen is the longest packet we'll accept before assuming we've lost framing.
+//
+// The longest m8 command is a waveform: 4 bytes of header and a byte per column of the screen.
+const slipMaxPacketLen = 1024
+
 type slipPacket []byte
 
-type slipReader struct {
-	escaped bool
-	prev    []byte
+type slipState int
+
+const (
+	// slipStateNormal is reading packet data.
+	slipStateNormal slipState = iota
+
+	// slipStateEscaped has just seen slipEsc and expects slipEscEnd or slipEscEsc.
+	slipStateEscaped
+
+	// slipStateResync has lost framing and is discarding data until the next slipEnd.
+	slipStateResync
+)
+
+// slipStats counts what the SLIP decoder has seen.
+type slipStats struct {
+	packets uint64
+
+	// invalidEscapes is the number of slipEsc bytes followed by something other than slipEscEnd or slipEscEsc.
+	invalidEscapes uint64
+
+	// oversizedPackets is the number of packets that grew past slipMaxPacketLen.
+	oversizedPackets uint64
+
+	// discardedBytes is the number of bytes thrown away while resynchronising.
+	discardedBytes uint64
 }
 
-func (r *slipReader) Read(dev io.ReadWriter) ([]byte, error) {
-	buf := make([]byte, 4*1024)
+func (s slipStats) errors() uint64 {
+	return s.invalidEscapes + s.oversizedPackets
+}
 
-	n, err := dev.Read(buf)
-	if err != nil {
-		return nil, errors.Wrap(err, "error reading SLIP data from device")
-	}
+func (s slipStats) String() string {
+	return fmt.Sprintf("packets: %d; invalid escapes: %d; oversized packets: %d; discarded bytes: %d", s.packets, s.invalidEscapes, s.oversizedPackets, s.discardedBytes)
+}
+
+// slipReader decodes SLIP framed data a byte at a time.
+//
+// Decoding state is carried across calls to Decode, so packets (and escape sequences) can be split across reads.
+// Framing errors never fail decoding: the broken packet is dropped, the error counted in stats and the decoder
+// resynchronises on the next slipEnd.
+//
+// To keep the garbage collector quiet, nothing is allocated once the reader has warmed up: the buffer returned by
+// Read is only valid until the next Read, and the packets returned by Decode are only valid until the next Decode.
+type slipReader struct {
+	state slipState
+	stats slipStats
+
+	// readBuf is reused by every Read.
+	readBuf [4 * 1024]byte
+
+	// packetBuf holds the packets decoded by the last Decode followed by the packet in progress, which starts at
+	// packetStart.
+	packetBuf   []byte
+	packetStart int
 
-	return buf[:n], nil
+	// packets is reused by every Decode.
+	packets []slipPacket
+
+	// protocol is the display protocol the m8 seems to be speaking.
+	protocol displayProtocol
+
+	// lastColor is the color of the last rect, which newer firmware leaves out of rects drawn in the same color.
+	lastColor color
+
+	// screen is the size of the m8's screen this session, going by the model in its system info; if it's zero, the
+	// m8 hasn't said and it's defaultScreenSize.
+	screen size
 }
 
-func (r *slipReader) Decode(data []byte) ([]slipPacket, error) {
-	var (
-		packets []slipPacket
-		packet  slipPacket = r.prev
-	)
+// displayProtocol is a version of the m8's display protocol.
+type displayProtocol int
 
-	for i := 0; i < len(data); i++ {
-		ch := data[i]
+const (
+	// displayProtocolV1 is the original protocol: every rect is sent in full and there's no system info. Until the
+	// m8 sends something newer, this is what it's assumed to be speaking.
+	displayProtocolV1 displayProtocol = iota
 
-		switch ch {
-		case slipEnd:
-			if len(packet) > 0 {
-				packets = append(packets, packet)
-			}
+	// displayProtocolV2 is newer firmware's: rects leave out whatever's the same as the last one's, and the m8
+	// reports its model, firmware version and font mode.
+	displayProtocolV2
+)
 
-			packet = nil
+func (p displayProtocol) String() string {
+	return fmt.Sprintf("v%d", int(p)+1)
+}
 
-			continue
+func (r *slipReader) Read(dev io.ReadWriter) ([]byte, error) {
+	n, err := dev.Read(r.readBuf[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading SLIP data from device")
+	}
 
-		case slipEsc:
-			r.escaped = true
+	return r.readBuf[:n], nil
+}
 
-			i++
-			switch ch := data[i]; ch {
+// Decode decodes data, returning the packets it completes.
+//
+// There's no error: framing errors are counted in Stats rather than failing the read, since the next packet's as
+// good as ever once the decoder's resynchronised.
+func (r *slipReader) Decode(data []byte) []slipPacket {
+	// The packets from the last Decode are done with, so move the packet in progress to the front of the buffer and
+	// reuse the rest.
+	n := copy(r.packetBuf, r.packetBuf[r.packetStart:])
+	r.packetBuf = r.packetBuf[:n]
+	r.packetStart = 0
+	r.packets = r.packets[:0]
+
+	for _, ch := range data {
+		switch r.state {
+		case slipStateResync:
+			if ch == slipEnd {
+				r.state = slipStateNormal
+			} else {
+				r.stats.discardedBytes++
+			}
+
+		case slipStateEscaped:
+			switch ch {
 			case slipEscEnd:
-				packet = append(packet, slipEnd)
+				r.append(slipEnd)
 
 			case slipEscEsc:
-				packet = append(packet, slipEsc)
+				r.append(slipEsc)
 
 			default:
-				return nil, errors.Errorf("unexpected escaped ch %x", ch)
+				r.stats.invalidEscapes++
+				r.resync(ch)
 			}
 
-			continue
-
 		default:
-			packet = append(packet, ch)
+			switch ch {
+			case slipEnd:
+				if end := len(r.packetBuf); end > r.packetStart {
+					r.packets = append(r.packets, r.packetBuf[r.packetStart:end:end])
+					r.packetStart = end
+					r.stats.packets++
+				}
+
+			case slipEsc:
+				r.state = slipStateEscaped
+
+			default:
+				r.append(ch)
+			}
 		}
 	}
 
-	r.prev = packet
+	return r.packets
+}
 
-	return packets, nil
+// append adds ch to the current packet and goes back to the normal state.
+func (r *slipReader) append(ch byte) {
+	if len(r.packetBuf)-r.packetStart >= slipMaxPacketLen {
+		r.stats.oversizedPackets++
+		r.resync(ch)
+
+		return
+	}
+
+	r.packetBuf = append(r.packetBuf, ch)
+	r.state = slipStateNormal
+}
+
+// resync drops the current packet and discards everything up to the next slipEnd.
+//
+// ch is the byte that caused the error; if it happens to be slipEnd we're already back in sync.
+func (r *slipReader) resync(ch byte) {
+	r.stats.discardedBytes += uint64(len(r.packetBuf) - r.packetStart)
+	r.packetBuf = r.packetBuf[:r.packetStart]
+
+	if ch == slipEnd {
+		r.state = slipStateNormal
+		return
+	}
+
+	r.stats.discardedBytes++
+	r.state = slipStateResync
 }
 
-// DecodeCommand decodes the given M8 SLIP command packet
-func (r slipReader) DecodeCommand(packet []byte) (cmd, error) {
+// Stats returns the decoder's counters.
+func (r *slipReader) Stats() slipStats {
+	return r.stats
+}
+
+// Protocol returns the display protocol the m8 seems to be speaking.
+func (r *slipReader) Protocol() displayProtocol {
+	return r.protocol
+}
+
+// Reset discards any partially decoded packet, and forgets everything learnt about the m8, which might not be the
+// same one next time.
+func (r *slipReader) Reset() {
+	r.state = slipStateNormal
+	r.packetBuf = r.packetBuf[:0]
+	r.packetStart = 0
+	r.protocol = displayProtocolV1
+	r.lastColor = color{}
+	r.screen = size{}
+}
+
+// screenSize returns the size of the m8's screen this session.
+func (r *slipReader) screenSize() size {
+	if r.screen == (size{}) {
+		return defaultScreenSize
+	}
+
+	return r.screen
+}
+
+// DecodeCommand decodes the given M8 SLIP command packet into batch
+//
+// Newer firmware leaves out parts of commands that are the same as before, so decoding depends on what's been decoded
+// so far.
+func (r *slipReader) DecodeCommand(packet []byte, batch *cmdBatch) error {
 	n := len(packet)
 	if n == 0 {
-		return nil, errors.New("empty packet")
+		return errors.New("empty packet")
 	}
 
 	opcode := packet[0]
 	switch opcode {
 
+	// 255 (0xFF) - System info command (newer firmware only):
+	//    6 bytes. uint8 hardware model, uint8 firmware major version, uint8 minor version, uint8 patch version,
+	//    uint8 font mode
+	case systemInfoOpCode:
+		if n != 6 {
+			return errors.WithStack(errInvalidCmdLen{"system info", 6, packet})
+		}
+
+		cmd := SystemInfoCmd{hardwareModel(packet[1]), firmwareVersion{packet[2], packet[3], packet[4]}, fontMode(packet[5])}
+
+		r.protocol = displayProtocolV2
+		r.screen = cmd.model.screenSize()
+		batch.add(cmd)
+
+		return nil
+
 	// 253 (0xFD) - Draw character command:
 	//    12 bytes. char c, int16 x position, int16 y position, uint8 r, uint8 g, uint8 b, uint8 r_background, uint8 g_background, uint8 b_background
 	case drawCharacteOpCode:
 		if n != 12 {
-			return nil, errors.WithStack(errInvalidCmdLen{"draw character", 12, packet})
+			return errors.WithStack(errInvalidCmdLen{"draw character", 12, packet})
 		}
 
-		return DrawCharCmd{packet[1], r.decodePosition(packet[2:]), r.decodeColor(packet[6:]), r.decodeColor(packet[9:])}, nil
+		batch.addChar(DrawCharCmd{packet[1], r.decodePosition(packet[2:]), r.decodeColor(packet[6:]), r.decodeColor(packet[9:])})
+
+		return nil
 
 	// 254 (0xFE) - Draw rectangle command:
 	//    12 bytes. int16 x position, int16 y position, int16 width, int16 height, uint8 r, uint8 g, uint8 b
+	//
+	//    Newer firmware leaves out the size of 1x1 rects and the color of rects the same color as the last one:
+	//    5 bytes. int16 x position, int16 y position
+	//    8 bytes. int16 x position, int16 y position, uint8 r, uint8 g, uint8 b
+	//    9 bytes. int16 x position, int16 y position, int16 width, int16 height
 	case drawRectOpCode:
+		cmd := DrawRectCmd{size: size{1, 1}, color: r.lastColor}
+
+		switch n {
+		case 5:
+			cmd.pos = r.decodePosition(packet[1:])
+
+		case 8:
+			cmd.pos, cmd.color = r.decodePosition(packet[1:]), r.decodeColor(packet[5:])
+
+		case 9:
+			cmd.pos, cmd.size = r.decodePosition(packet[1:]), r.decodeSize(packet[5:])
+
+		case 12:
+			cmd.pos, cmd.size, cmd.color = r.decodePosition(packet[1:]), r.decodeSize(packet[5:]), r.decodeColor(packet[9:])
+
+		default:
+			return errors.WithStack(errInvalidCmdLen{"draw rect", 12, packet})
+		}
+
 		if n != 12 {
-			return nil, errors.WithStack(errInvalidCmdLen{"draw rect", 12, packet})
+			r.protocol = displayProtocolV2
 		}
 
-		return DrawRectCmd{r.decodePosition(packet[1:]), r.decodeSize(packet[5:]), r.decodeColor(packet[9:])}, nil
+		r.lastColor = cmd.color
+		batch.addRect(cmd)
+
+		return nil
 
 	// 252 (0xFC) - Draw oscilloscope waveform command:
-	//    zero bytes if off - uint8 r, uint8 g, uint8 b, followed by 320 byte value array containing the waveform
+	//    zero bytes if off - uint8 r, uint8 g, uint8 b, followed by a byte value array as wide as the screen containing
+	//    the waveform
 	case drawOscilloscopeWaveformOpCode:
 		if n < 4 {
-			return nil, errInvalidCmdLen{"draw osc wave", 4, packet}
+			return errInvalidCmdLen{"draw osc wave", 4, packet}
 		}
 
-		if waveformLength := n - 4; waveformLength != 0 && waveformLength != int(m8ScreenWidth) {
-			return nil, errors.WithStack(errInvalidCmdLen{"draw osc wave data", int(m8ScreenWidth), packet})
+		if width := int(r.screenSize().width); n-4 != 0 && n-4 != width {
+			return errors.WithStack(errInvalidCmdLen{"draw osc wave data", width, packet})
 		}
 
-		return DrawOscWaveformCmd{r.decodeColor(packet[1:]), packet[4:]}, nil
+		batch.addWaveform(DrawOscWaveformCmd{color: r.decodeColor(packet[1:])}, packet[4:])
+
+		return nil
 
 	// 251 (0xFB) - Joypad key pressed state (hardware M8 only)
 	//    - sends the keypress state as a single byte in hardware pin order: LEFT|UP|DOWN|SELECT|START|RIGHT|OPT|EDIT
 	case joypadKeyPressedStateOpCode:
 		if n != 3 {
-			return nil, errors.WithStack(errInvalidCmdLen{"joypad key pressed", 3, packet})
+			return errors.WithStack(errInvalidCmdLen{"joypad key pressed", 3, packet})
 		}
 
-		return JoypadKeyPressedCmd{packet[1]}, nil
+		batch.add(JoypadKeyPressedCmd{packet[1]})
+
+		return nil
 
 	default:
-		return nil, errUnknownCmd{opcode}
+		return errUnknownCmd{opcode}
 	}
 }
 
-func (r slipReader) decodeInt16(data []byte) int16 {
+func (r *slipReader) decodeInt16(data []byte) int16 {
 	return int16(binary.LittleEndian.Uint16(data))
 }
 
-func (r slipReader) decodePosition(data []byte) position {
+func (r *slipReader) decodePosition(data []byte) position {
 	return position{r.decodeInt16(data[0:2]), r.decodeInt16(data[2:4])}
 }
 
-func (r slipReader) decodeSize(data []byte) size {
+func (r *slipReader) decodeSize(data []byte) size {
 	return size{r.decodeInt16(data[0:2]), r.decodeInt16(data[2:4])}
 }
 
-func (r slipReader) decodeColor(data []byte) color {
+func (r *slipReader) decodeColor(data []byte) color {
 	return color{data[0], data[1], data[2]}
 }
 
@@ -164,7 +369,7 @@ func (r *safeSlipReader) Read(dev io.ReadWriter) ([]byte, error) {
 	{
 		var formattedBuf []string
 		for _, byt := range buf {
-			formattedBuf = append(formattedBuf, fmt.Sprintf("%X", byt))	
+			formattedBuf = append(formattedBuf, fmt.Sprintf("%X", byt))
 		}
 
 		r.logger.Printf("read bytes: %v\n", strings.Join(formattedBuf, " "))
@@ -173,23 +378,29 @@ func (r *safeSlipReader) Read(dev io.ReadWriter) ([]byte, error) {
 	return buf, nil
 }
 
-func (r *safeSlipReader) Decode(data []byte) ([]slipPacket, error) {
-	packets, err := r.reader.Decode(data)
-	if err != nil {
-		return nil, err
-	}
+func (r *safeSlipReader) Decode(data []byte) []slipPacket {
+	return r.reader.Decode(data)
+}
 
-	return packets, err
+func (r *safeSlipReader) Stats() slipStats {
+	return r.reader.Stats()
 }
 
-// DecodeCommand decodes the given M8 SLIP command packet
-func (r *safeSlipReader) DecodeCommand(packet []byte) (cmd, error) {
-	cmd, err := r.reader.DecodeCommand(packet)
-	if err != nil {
+func (r *safeSlipReader) Protocol() displayProtocol {
+	return r.reader.Protocol()
+}
+
+func (r *safeSlipReader) Reset() {
+	r.reader.Reset()
+}
+
+// DecodeCommand decodes the given M8 SLIP command packet into batch
+func (r *safeSlipReader) DecodeCommand(packet []byte, batch *cmdBatch) error {
+	if err := r.reader.DecodeCommand(packet, batch); err != nil {
 		r.logger.Printf("error decoding packet: %s; ignoring.\npacket: %x\n", err, packet)
 
-		return &NoOpCmd{}, nil
+		batch.add(&NoOpCmd{})
 	}
 
-	return cmd, nil
+	return nil
 }
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// slipEncode appends packet to buf as a SLIP frame.
+func slipEncode(buf []byte, packet []byte) []byte {
+	for _, ch := range packet {
+		switch ch {
+		case slipEnd:
+			buf = append(buf, slipEsc, slipEscEnd)
+		case slipEsc:
+			buf = append(buf, slipEsc, slipEscEsc)
+		default:
+			buf = append(buf, ch)
+		}
+	}
+
+	return append(buf, slipEnd)
+}
+
+func encodeRect(x, y, w, h int16, c color) []byte {
+	packet := []byte{drawRectOpCode}
+	for _, v := range []int16{x, y, w, h} {
+		packet = binary.LittleEndian.AppendUint16(packet, uint16(v))
+	}
+
+	return append(packet, c.r, c.g, c.b)
+}
+
+func encodeChar(ch byte, x, y int16, fg, bg color) []byte {
+	packet := []byte{drawCharacteOpCode, ch}
+	packet = binary.LittleEndian.AppendUint16(packet, uint16(x))
+	packet = binary.LittleEndian.AppendUint16(packet, uint16(y))
+
+	return append(packet, fg.r, fg.g, fg.b, bg.r, bg.g, bg.b)
+}
+
+func encodeWaveform(c color, waveform []byte) []byte {
+	return append([]byte{drawOscilloscopeWaveformOpCode, c.r, c.g, c.b}, waveform...)
+}
+
+// testTraffic returns SLIP encoded traffic resembling an m8 session: a full redraw of the screen followed by a
+// stream of waveform and cursor updates.
+func testTraffic() []byte {
+	var (
+		buf []byte
+		fg  = color{0xfa, 0xfa, 0xfa}
+		bg  = color{0x00, 0x00, 0x00}
+		hl  = color{0x00, 0xdb, 0xc0}
+	)
+
+	buf = slipEncode(buf, encodeRect(0, 0, defaultScreenSize.width, defaultScreenSize.height, bg))
+
+	for row := int16(0); row < 24; row++ {
+		for col := int16(0); col < 39; col++ {
+			buf = slipEncode(buf, encodeChar(byte('0'+(row+col)%64), col*8, row*10, fg, bg))
+		}
+	}
+
+	waveform := make([]byte, defaultScreenSize.width)
+	for frame := 0; frame < 60; frame++ {
+		for x := range waveform {
+			waveform[x] = byte((x*frame/4)%30) + 2
+		}
+
+		buf = slipEncode(buf, encodeWaveform(hl, waveform))
+		buf = slipEncode(buf, encodeRect(0, int16(frame%24)*10, 8, 10, hl))
+		buf = slipEncode(buf, encodeChar('-', 8, int16(frame%24)*10, fg, hl))
+	}
+
+	return buf
+}
+
+// benchCapturePath is a capture of a session with a real m8, for benchmarking over.
+const benchCapturePath = "testdata/session.m8cap"
+
+// benchTraffic returns the SLIP encoded traffic read from the m8 in the capture at benchCapturePath, or testTraffic if
+// there isn't one.
+func benchTraffic(b *testing.B) []byte {
+	b.Helper()
+
+	file, err := os.Open(benchCapturePath)
+	if os.IsNotExist(err) {
+		b.Logf("no capture at %s; benchmarking over synthetic traffic", benchCapturePath)
+		return testTraffic()
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+
+	replay, err := newReplayDevice(file, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	traffic, err := io.ReadAll(replay)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	if len(traffic) == 0 {
+		b.Fatalf("nothing read from the m8 in %s", benchCapturePath)
+	}
+
+	return traffic
+}
+
+// loopDevice replays data forever, at most chunk bytes per read.
+type loopDevice struct {
+	data  []byte
+	pos   int
+	chunk int
+}
+
+func (d *loopDevice) Read(buf []byte) (int, error) {
+	if len(buf) > d.chunk {
+		buf = buf[:d.chunk]
+	}
+
+	n := copy(buf, d.data[d.pos:])
+	if d.pos += n; d.pos == len(d.data) {
+		d.pos = 0
+	}
+
+	return n, nil
+}
+
+func (d *loopDevice) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func TestSlipDecode(t *testing.T) {
+	oversized := make([]byte, slipMaxPacketLen+1)
+	for i := range oversized {
+		oversized[i] = 0x01
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		packets []slipPacket
+		stats   slipStats
+	}{
+		{
+			name:    "escapes",
+			data:    []byte{0x01, slipEsc, slipEscEnd, 0x02, slipEsc, slipEscEsc, slipEnd},
+			packets: []slipPacket{{0x01, slipEnd, 0x02, slipEsc}},
+			stats:   slipStats{packets: 1},
+		},
+		{
+			name:    "empty frames",
+			data:    []byte{slipEnd, slipEnd, 0x01, slipEnd, slipEnd},
+			packets: []slipPacket{{0x01}},
+			stats:   slipStats{packets: 1},
+		},
+		{
+			// The packet so far, the bad escape and everything up to the next slipEnd are thrown away.
+			name:    "invalid escape",
+			data:    []byte{0x01, 0x02, slipEsc, 0x05, 0x03, 0x04, slipEnd, 0x07, 0x08, slipEnd},
+			packets: []slipPacket{{0x07, 0x08}},
+			stats:   slipStats{packets: 1, invalidEscapes: 1, discardedBytes: 5},
+		},
+		{
+			// An escaped slipEnd is still the end of the frame, so there's nothing to resync.
+			name:    "invalid escape of end",
+			data:    []byte{0x01, slipEsc, slipEnd, 0x02, slipEnd},
+			packets: []slipPacket{{0x02}},
+			stats:   slipStats{packets: 1, invalidEscapes: 1, discardedBytes: 1},
+		},
+		{
+			name:    "oversized packet",
+			data:    append(append(append([]byte{}, oversized...), slipEnd), 0x09, slipEnd),
+			packets: []slipPacket{{0x09}},
+			stats:   slipStats{packets: 1, oversizedPackets: 1, discardedBytes: slipMaxPacketLen + 1},
+		},
+	}
+
+	for _, test := range tests {
+		// However the stream's split up, escapes included, it should decode the same.
+		for _, chunk := range []int{1, 2, 3, 7, len(test.data)} {
+			var (
+				rdr     = &slipReader{}
+				packets []slipPacket
+			)
+
+			for start := 0; start < len(test.data); start += chunk {
+				end := start + chunk
+				if end > len(test.data) {
+					end = len(test.data)
+				}
+
+				// Packets are only valid until the next Decode.
+				for _, packet := range rdr.Decode(test.data[start:end]) {
+					packets = append(packets, append(slipPacket(nil), packet...))
+				}
+			}
+
+			if !reflect.DeepEqual(packets, test.packets) {
+				t.Errorf("%s in chunks of %d: got packets %x, want %x", test.name, chunk, packets, test.packets)
+			}
+
+			if stats := rdr.Stats(); stats != test.stats {
+				t.Errorf("%s in chunks of %d: got stats %s, want %s", test.name, chunk, stats, test.stats)
+			}
+		}
+	}
+}
+
+func BenchmarkSlipReaderRead(b *testing.B) {
+	var (
+		traffic = benchTraffic(b)
+		dev     = &loopDevice{data: traffic, chunk: 512}
+		rdr     = &slipReader{}
+	)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.SetBytes(512)
+
+	for i := 0; i < b.N; i++ {
+		if _, err := rdr.Read(dev); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSlipReaderDecode(b *testing.B) {
+	var (
+		traffic = benchTraffic(b)
+		rdr     = &slipReader{}
+	)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.SetBytes(int64(len(traffic)))
+
+	for i := 0; i < b.N; i++ {
+		rdr.Decode(traffic)
+	}
+}
+
+func BenchmarkControllerNextCmds(b *testing.B) {
+	var (
+		traffic = benchTraffic(b)
+		ctrl    = controller{
+			logger: log.New(io.Discard, "", 0),
+			slip:   &slipReader{},
+			device: &loopDevice{data: traffic, chunk: 512},
+		}
+	)
+
+	var batch cmdBatch
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.SetBytes(512)
+
+	for i := 0; i < b.N; i++ {
+		if err := ctrl.nextCmds(&batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeRectVariants(t *testing.T) {
+	var (
+		rdr = &slipReader{}
+		red = color{0xff, 0x00, 0x00}
+		blu = color{0x00, 0x00, 0xff}
+		pos = binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, 10), 20)
+		sz  = binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, 3), 4)
+	)
+
+	tests := []struct {
+		packet []byte
+		want   DrawRectCmd
+	}{
+		{encodeRect(10, 20, 3, 4, red), DrawRectCmd{position{10, 20}, size{3, 4}, red}},
+
+		// Rects without a color are the same color as the last one, and rects without a size are 1x1.
+		{append([]byte{drawRectOpCode}, pos...), DrawRectCmd{position{10, 20}, size{1, 1}, red}},
+		{append(append([]byte{drawRectOpCode}, pos...), blu.r, blu.g, blu.b), DrawRectCmd{position{10, 20}, size{1, 1}, blu}},
+		{append(append([]byte{drawRectOpCode}, pos...), sz...), DrawRectCmd{position{10, 20}, size{3, 4}, blu}},
+	}
+
+	for i, test := range tests {
+		var batch cmdBatch
+		if err := rdr.DecodeCommand(test.packet, &batch); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+
+		if cmd := *batch.cmds[0].(*DrawRectCmd); cmd != test.want {
+			t.Errorf("%d: got %+v, want %+v", i, cmd, test.want)
+		}
+	}
+
+	if rdr.Protocol() != displayProtocolV2 {
+		t.Errorf("got protocol %s after short rects", rdr.Protocol())
+	}
+}
+
+func TestDecodeSystemInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		packet   []byte
+		want     SystemInfoCmd
+		wantFont fontMode
+		wantLog  string
+	}{
+		{
+			name:     "large font",
+			packet:   []byte{systemInfoOpCode, 3, 4, 0, 1, 1},
+			want:     SystemInfoCmd{hardwareModelModel02, firmwareVersion{4, 0, 1}, fontModeLarge},
+			wantFont: fontModeLarge,
+		},
+		{
+			// Newer firmware might have font modes we don't know about, which mustn't stop the m8 being shown.
+			name:     "unknown font mode",
+			packet:   []byte{systemInfoOpCode, 3, 5, 1, 0, 7},
+			want:     SystemInfoCmd{hardwareModelModel02, firmwareVersion{5, 1, 0}, 7},
+			wantFont: fontModeSmall,
+			wantLog:  "unknown font mode 7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rdr := &slipReader{}
+
+			var batch cmdBatch
+			if err := rdr.DecodeCommand(tt.packet, &batch); err != nil {
+				t.Fatal(err)
+			}
+
+			if cmd := batch.cmds[0]; cmd != tt.want {
+				t.Errorf("got %+v, want %+v", cmd, tt.want)
+			}
+
+			if rdr.Protocol() != displayProtocolV2 {
+				t.Errorf("got protocol %s after system info", rdr.Protocol())
+			}
+
+			var (
+				logs     bytes.Buffer
+				renderer = newRenderer(newFramebufferRenderBackend())
+			)
+
+			if err := batch.cmds[0].execute(&controllerContext{log.New(&logs, "", 0), renderer}); err != nil {
+				t.Fatal(err)
+			}
+
+			if renderer.fontMode != tt.wantFont {
+				t.Errorf("got font mode %d, want %d", renderer.fontMode, tt.wantFont)
+			}
+
+			if want := hardwareModelModel02.screenSize(); renderer.screen != want {
+				t.Errorf("got screen %+v, want %+v", renderer.screen, want)
+			}
+
+			if !strings.Contains(logs.String(), tt.wantLog) || !strings.Contains(logs.String(), "firmware "+tt.want.firmware.String()) {
+				t.Errorf("got log %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestCmdBatchKeepsCommandsAsItGrows(t *testing.T) {
+	var (
+		rdr   = &slipReader{}
+		batch cmdBatch
+	)
+
+	for i := int16(0); i < 100; i++ {
+		if err := rdr.DecodeCommand(encodeRect(i, 0, 1, 1, color{}), &batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, cmd := range batch.cmds {
+		if x := cmd.(*DrawRectCmd).pos.x; x != int16(i) {
+			t.Fatalf("command %d has x %d", i, x)
+		}
+	}
+}
+
+func TestCmdBatchKeepsWaveformsAsItGrows(t *testing.T) {
+	var (
+		rdr   = &slipReader{}
+		batch cmdBatch
+	)
+
+	for i := 0; i < 10; i++ {
+		packet := encodeWaveform(color{}, bytes.Repeat([]byte{byte(i)}, int(defaultScreenSize.width)))
+		if err := rdr.DecodeCommand(packet, &batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, cmd := range batch.cmds {
+		if waveform := cmd.(*DrawOscWaveformCmd).waveform; !bytes.Equal(waveform, bytes.Repeat([]byte{byte(i)}, int(defaultScreenSize.width))) {
+			t.Fatalf("waveform %d is %v", i, waveform)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errDeviceDisconnected is returned by a deviceSupervisor when the device has gone away.
+var errDeviceDisconnected = errors.New("device disconnected")
+
+// deviceSupervisor owns the connection to the m8 and reopens it when it drops.
+//
+// It implements io.ReadWriter so it can stand in for the device itself; once the underlying device fails, every
+// Read and Write returns errDeviceDisconnected until reconnect succeeds.
+type deviceSupervisor struct {
+	logger   *log.Logger
+	open     func() (io.ReadWriteCloser, error)
+	pollRate time.Duration
+
+	mu      sync.Mutex
+	writeMu sync.Mutex
+	device  io.ReadWriteCloser
+}
+
+// newDeviceSupervisor creates a supervisor and tries to open the device.
+//
+// If the device can't be opened yet, the supervisor starts out disconnected.
+func newDeviceSupervisor(logger *log.Logger, open func() (io.ReadWriteCloser, error), pollRate time.Duration) *deviceSupervisor {
+	device, err := open()
+	if err != nil {
+		logger.Printf("error opening device: %s\n", err)
+		device = nil
+	}
+
+	return &deviceSupervisor{
+		logger:   logger,
+		open:     open,
+		pollRate: pollRate,
+		device:   device,
+	}
+}
+
+func (s *deviceSupervisor) current() io.ReadWriteCloser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.device
+}
+
+// drop closes the device if it's still the current one.
+func (s *deviceSupervisor) drop(device io.ReadWriteCloser, cause error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.device != device {
+		return
+	}
+
+	s.logger.Printf("lost device: %s\n", cause)
+
+	device.Close()
+	s.device = nil
+}
+
+func (s *deviceSupervisor) Read(buf []byte) (int, error) {
+	device := s.current()
+	if device == nil {
+		return 0, errDeviceDisconnected
+	}
+
+	n, err := device.Read(buf)
+	if err != nil {
+		s.drop(device, err)
+		return n, errors.Wrap(errDeviceDisconnected, err.Error())
+	}
+
+	return n, nil
+}
+
+func (s *deviceSupervisor) Write(buf []byte) (int, error) {
+	device := s.current()
+	if device == nil {
+		return 0, errDeviceDisconnected
+	}
+
+	// Writes come from both the input loop and the read loop, so make sure they don't interleave.
+	s.writeMu.Lock()
+	n, err := device.Write(buf)
+	s.writeMu.Unlock()
+
+	if err != nil {
+		s.drop(device, err)
+		return n, errors.Wrap(errDeviceDisconnected, err.Error())
+	}
+
+	return n, nil
+}
+
+// reconnect polls until the device can be opened again.
+func (s *deviceSupervisor) reconnect() {
+	for {
+		device, err := s.open()
+		if err == nil {
+			s.mu.Lock()
+			s.device = device
+			s.mu.Unlock()
+
+			s.logger.Println("device reconnected")
+			return
+		}
+
+		<-time.After(s.pollRate)
+	}
+}
+
+func isDisconnected(err error) bool {
+	return errors.Cause(err) == errDeviceDisconnected
+}
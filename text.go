@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// textCell is a character on the m8's screen; ch is 0 where nothing's been drawn.
+type textCell struct {
+	ch     byte
+	fg, bg color
+}
+
+// textGrid models the text on the m8's screen as a grid of character cells, built from the characters it draws, so
+// the screen can be read without OCR.
+//
+// The m8 draws characters on a fixed grid, so each one is put in the cell its position falls in. Characters drawn
+// without a background are given the screen's background. Colors are the m8's own rather than the theme's, so what
+// scripts read and where the cursor's found don't depend on the theme.
+type textGrid struct {
+	// cellSize is the size of each cell, taken from the font.
+	cellSize      size
+	columns, rows int
+	cells         []textCell
+
+	// changed is whether anything's changed since it was last cleared.
+	changed bool
+}
+
+// textCellSize returns the size of a cell of text in f: a glyph wide, and a pixel taller than a character's
+// background, since the m8 leaves a gap between the backgrounds of one row and the next.
+func textCellSize(f *font) size {
+	return size{int16(f.metrics.GlyphWidth), int16(f.metrics.BackgroundHeight + 1)}
+}
+
+// resize resizes the grid for screen and cells of cellSize, clearing it if either has changed.
+func (g *textGrid) resize(screen size, cellSize size) {
+	columns, rows := int(screen.width/cellSize.width), int(screen.height/cellSize.height)
+	if cellSize == g.cellSize && columns == g.columns && rows == g.rows {
+		return
+	}
+
+	g.cellSize, g.columns, g.rows = cellSize, columns, rows
+	g.cells = make([]textCell, columns*rows)
+	g.changed = true
+}
+
+// cellAt returns the cell that pos falls in, if it's on the screen.
+func (g *textGrid) cellAt(pos position) (*textCell, bool) {
+	if pos.x < 0 || pos.y < 0 {
+		return nil, false
+	}
+
+	column, row := int(pos.x/g.cellSize.width), int(pos.y/g.cellSize.height)
+	if column >= g.columns || row >= g.rows {
+		return nil, false
+	}
+
+	return &g.cells[row*g.columns+column], true
+}
+
+// drawChar records a character drawn at pos.
+func (g *textGrid) drawChar(ch byte, pos position, fg, bg color) {
+	cell, ok := g.cellAt(pos)
+	if !ok {
+		return
+	}
+
+	if drawn := (textCell{ch, fg, bg}); *cell != drawn {
+		*cell = drawn
+		g.changed = true
+	}
+}
+
+// clearRect clears the cells entirely covered by a rectangle drawn over them.
+func (g *textGrid) clearRect(pos position, size size) {
+	if g.cellSize.width <= 0 || g.cellSize.height <= 0 {
+		return
+	}
+
+	var (
+		// Round the top left corner up and the bottom right down to whole cells.
+		left   = (int(pos.x) + int(g.cellSize.width) - 1) / int(g.cellSize.width)
+		top    = (int(pos.y) + int(g.cellSize.height) - 1) / int(g.cellSize.height)
+		right  = (int(pos.x) + int(size.width)) / int(g.cellSize.width)
+		bottom = (int(pos.y) + int(size.height)) / int(g.cellSize.height)
+	)
+
+	if left < 0 {
+		left = 0
+	}
+	if top < 0 {
+		top = 0
+	}
+	if right > g.columns {
+		right = g.columns
+	}
+	if bottom > g.rows {
+		bottom = g.rows
+	}
+
+	for row := top; row < bottom; row++ {
+		for column := left; column < right; column++ {
+			if cell := &g.cells[row*g.columns+column]; cell.ch != 0 {
+				*cell = textCell{}
+				g.changed = true
+			}
+		}
+	}
+}
+
+// line returns the text of a row, with nothing drawn as spaces and trailing space trimmed.
+func (g *textGrid) line(row int) string {
+	var b strings.Builder
+	for _, cell := range g.cells[row*g.columns : (row+1)*g.columns] {
+		if cell.ch == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(cell.ch)
+		}
+	}
+
+	return strings.TrimRight(b.String(), " ")
+}
+
+// lines returns the text of every row, without the blank rows at the bottom.
+func (g *textGrid) lines() []string {
+	lines := make([]string, g.rows)
+	for row := range lines {
+		lines[row] = g.line(row)
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// cursor returns the first cell, left to right and top to bottom, highlighted with a background other than the
+// screen's, which is where the m8 puts its cursor.
+func (g *textGrid) cursor(screenBg color) (column, row int, ok bool) {
+	for i, cell := range g.cells {
+		if cell.ch != 0 && cell.bg != screenBg {
+			return i % g.columns, i / g.columns, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// dump writes the text on the screen to w, followed by where the cursor is.
+func (g *textGrid) dump(w io.Writer, screenBg color) error {
+	var b strings.Builder
+	for _, line := range g.lines() {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+
+	if column, row, ok := g.cursor(screenBg); ok {
+		fmt.Fprintf(&b, "-- cursor at row %d, column %d\n", row, column)
+	} else {
+		b.WriteString("--\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"reflect"
+	"testing"
+)
+
+func TestTextGrid(t *testing.T) {
+	packets := [][]byte{encodeRect(0, 0, defaultScreenSize.width, defaultScreenSize.height, goldenBg)}
+
+	for i, ch := range []byte("SONG") {
+		packets = append(packets, encodeChar(ch, int16(i)*8, 10, goldenFg, goldenFg))
+	}
+	for i, ch := range []byte("00 C-4") {
+		packets = append(packets, encodeChar(ch, int16(i)*8, 30, goldenFg, goldenBg))
+	}
+
+	// The cursor's on the note.
+	for i, ch := range []byte("C-4") {
+		packets = append(packets, encodeChar(ch, 24+int16(i)*8, 30, goldenBg, goldenHighlight))
+	}
+
+	renderer, _ := renderPackets(t, packets...)
+	text := &renderer.text
+
+	if want := []string{"", "SONG", "", "00 C-4"}; !reflect.DeepEqual(text.lines(), want) {
+		t.Fatalf("got lines %q; want %q", text.lines(), want)
+	}
+
+	if column, row, ok := text.cursor(renderer.bgColor); !ok || column != 3 || row != 3 {
+		t.Fatalf("got cursor at column %d, row %d (%v); want column 3, row 3", column, row, ok)
+	}
+
+	var dump bytes.Buffer
+	if err := text.dump(&dump, renderer.bgColor); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "\nSONG\n\n00 C-4\n-- cursor at row 3, column 3\n"; dump.String() != want {
+		t.Fatalf("dumped %q; want %q", dump.String(), want)
+	}
+
+	// A rectangle only clears the cells it covers entirely.
+	text.clearRect(position{4, 30}, size{20, 10})
+
+	if got := text.line(3); got != "0  C-4" {
+		t.Fatalf("got %q after clearing; want %q", got, "0  C-4")
+	}
+}
+
+func TestTextGridIgnoresTheme(t *testing.T) {
+	var (
+		renderer = newRenderer(newFramebufferRenderBackend())
+		ctx      = &controllerContext{log.New(io.Discard, "", 0), renderer}
+	)
+
+	// Monochrome maps the background and highlight to the same color.
+	renderer.themes = &themeSet{themes: append([]*theme{{Name: "off"}}, builtinThemes...)}
+	renderer.themes.use("monochrome")
+
+	cmds := []cmd{
+		DrawRectCmd{position{0, 0}, defaultScreenSize, goldenBg},
+		DrawCharCmd{'A', position{0, 10}, goldenFg, goldenFg},
+		DrawCharCmd{'B', position{8, 10}, goldenBg, goldenHighlight},
+	}
+	for _, cmd := range cmds {
+		if err := cmd.execute(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cell, _ := renderer.text.cellAt(position{8, 10}); cell.fg != goldenBg || cell.bg != goldenHighlight {
+		t.Fatalf("got colors %v on %v; want the m8's %v on %v", cell.fg, cell.bg, goldenBg, goldenHighlight)
+	}
+
+	if column, row, ok := renderer.text.cursor(renderer.bgColor); !ok || column != 1 || row != 1 {
+		t.Fatalf("got cursor at column %d, row %d (%v); want column 1, row 1", column, row, ok)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// theme remaps the colors the m8 sends to the user's own.
+//
+// Colors in colors are mapped exactly; anything else is mapped to the nearest color in palette. With an empty palette,
+// colors that aren't in colors are left alone.
+type theme struct {
+	Name    string          `json:"name"`
+	Colors  map[color]color `json:"colors,omitempty"`
+	Palette []color         `json:"palette,omitempty"`
+
+	// nearest caches palette lookups, since the m8 only ever uses a handful of colors.
+	nearest map[color]color
+}
+
+// themeCacheLimit is how many nearest color lookups a theme remembers before starting again.
+const themeCacheLimit = 4096
+
+// builtinThemes are always available, whatever the theme file has in it.
+var builtinThemes = []*theme{
+	{
+		Name: "high-contrast",
+		Palette: []color{
+			{0x00, 0x00, 0x00}, {0xff, 0xff, 0xff}, {0xff, 0xff, 0x00}, {0x00, 0xff, 0xff},
+			{0xff, 0x00, 0xff}, {0xff, 0x00, 0x00}, {0x00, 0xff, 0x00}, {0x00, 0x00, 0xff},
+		},
+	},
+	{
+		// The Okabe-Ito palette, which stays distinguishable with the common kinds of color blindness.
+		Name: "colorblind",
+		Palette: []color{
+			{0x00, 0x00, 0x00}, {0xff, 0xff, 0xff}, {0xe6, 0x9f, 0x00}, {0x56, 0xb4, 0xe9},
+			{0x00, 0x9e, 0x73}, {0xf0, 0xe4, 0x42}, {0x00, 0x72, 0xb2}, {0xd5, 0x5e, 0x00},
+			{0xcc, 0x79, 0xa7},
+		},
+	},
+	{
+		Name:    "monochrome",
+		Palette: []color{{0x00, 0x00, 0x00}, {0x55, 0x55, 0x55}, {0xaa, 0xaa, 0xaa}, {0xff, 0xff, 0xff}},
+	},
+}
+
+// remap returns the theme's color for c.
+func (t *theme) remap(c color) color {
+	if mapped, ok := t.Colors[c]; ok {
+		return mapped
+	}
+
+	if len(t.Palette) == 0 {
+		return c
+	}
+
+	if mapped, ok := t.nearest[c]; ok {
+		return mapped
+	}
+
+	if t.nearest == nil || len(t.nearest) >= themeCacheLimit {
+		t.nearest = map[color]color{}
+	}
+
+	mapped := t.Palette[0]
+	for _, candidate := range t.Palette[1:] {
+		if colorDistance(c, candidate) < colorDistance(c, mapped) {
+			mapped = candidate
+		}
+	}
+
+	t.nearest[c] = mapped
+
+	return mapped
+}
+
+// colorDistance is how different two colors look, weighted roughly the way eyes weight red, green and blue.
+func colorDistance(a, b color) int {
+	var (
+		rMean = (int(a.r) + int(b.r)) / 2
+		dr    = int(a.r) - int(b.r)
+		dg    = int(a.g) - int(b.g)
+		db    = int(a.b) - int(b.b)
+	)
+
+	return ((512+rMean)*dr*dr)>>8 + 4*dg*dg + ((767-rMean)*db*db)>>8
+}
+
+// themeSet is the themes that can be switched between at runtime.
+//
+// The first theme is always "off", which leaves the m8's colors alone.
+type themeSet struct {
+	themes  []*theme
+	current int
+}
+
+// loadThemes returns the built in themes plus any in the theme file at path, starting on the theme called name.
+//
+// If path is empty, themes.json in the client's config dir is used if there is one.
+func loadThemes(path, name string) (*themeSet, error) {
+	set := themeSet{themes: append([]*theme{{Name: "off"}}, builtinThemes...)}
+
+	explicit := path != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err == nil {
+			path = filepath.Join(dir, "m8client", "themes.json")
+		}
+	}
+
+	if path != "" {
+		themes, err := readThemeFile(path)
+		if err != nil && (explicit || !os.IsNotExist(errors.Cause(err))) {
+			return nil, err
+		}
+
+		set.themes = append(set.themes, themes...)
+	}
+
+	if name != "" && !set.use(name) {
+		return nil, errors.Errorf("unknown theme %q (have %s)", name, set.names())
+	}
+
+	return &set, nil
+}
+
+// readThemeFile reads a JSON list of themes, with colors written as RRGGBB:
+//
+//	[{"name": "mine", "colors": {"ff0000": "00ff00"}, "palette": ["000000", "ffffff"]}]
+func readThemeFile(path string) ([]*theme, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading theme file")
+	}
+
+	var themes []*theme
+	if err := json.Unmarshal(data, &themes); err != nil {
+		return nil, errors.Wrapf(err, "error parsing theme file %s", path)
+	}
+
+	for i, theme := range themes {
+		if theme.Name == "" {
+			return nil, errors.Errorf("theme %d in %s has no name", i, path)
+		}
+	}
+
+	return themes, nil
+}
+
+// use switches to the theme called name, if there is one; themes later in the set override earlier ones.
+func (s *themeSet) use(name string) bool {
+	for i := len(s.themes) - 1; i >= 0; i-- {
+		if s.themes[i].Name == name {
+			s.current = i
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *themeSet) names() string {
+	names := make([]string, len(s.themes))
+	for i, theme := range s.themes {
+		names[i] = theme.Name
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// next switches to the next theme and returns its name.
+func (s *themeSet) next() string {
+	s.current = (s.current + 1) % len(s.themes)
+	return s.themes[s.current].Name
+}
+
+// remap returns the current theme's color for c.
+func (s *themeSet) remap(c color) color {
+	if s.current == 0 {
+		return c
+	}
+
+	return s.themes[s.current].remap(c)
+}
+
+// MarshalText writes colors as RRGGBB.
+func (c color) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%02x%02x%02x", c.r, c.g, c.b)), nil
+}
+
+// UnmarshalText lets colors be written as RRGGBB in theme files, including as map keys.
+func (c *color) UnmarshalText(text []byte) error {
+	parsed, err := parseColor(string(text))
+	if err != nil {
+		return err
+	}
+
+	*c = parsed
+
+	return nil
+}
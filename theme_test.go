@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThemeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "themes.json")
+	if err := os.WriteFile(path, []byte(`[{"name": "mine", "colors": {"ff0000": "00ff00"}, "palette": ["000000", "#ffffff"]}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	themes, err := loadThemes(path, "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in, want color
+	}{
+		// Exact matches win over the palette.
+		{color{0xff, 0x00, 0x00}, color{0x00, 0xff, 0x00}},
+
+		// Anything else goes to the nearest color in the palette.
+		{color{0x20, 0x10, 0x30}, color{0x00, 0x00, 0x00}},
+		{color{0xe0, 0xd0, 0xf0}, color{0xff, 0xff, 0xff}},
+	}
+
+	for _, test := range tests {
+		if got := themes.remap(test.in); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.in, got, test.want)
+		}
+	}
+
+	if _, err := loadThemes(path, "missing"); err == nil {
+		t.Error("expected an error for an unknown theme")
+	}
+}
+
+func TestThemeKeepsCharBackground(t *testing.T) {
+	var (
+		backend  = newFramebufferRenderBackend()
+		renderer = newRenderer(backend)
+		ctx      = &controllerContext{log.New(io.Discard, "", 0), renderer}
+		pos      = position{16, 20}
+
+		// Both of these are nearest to 555555 in the monochrome theme.
+		fg = color{0x60, 0x60, 0x60}
+		bg = color{0x50, 0x50, 0x50}
+	)
+
+	renderer.themes = &themeSet{themes: append([]*theme{{Name: "off"}}, builtinThemes...)}
+	if !renderer.themes.use("monochrome") {
+		t.Fatal("no monochrome theme")
+	}
+
+	if renderer.themed(fg) != renderer.themed(bg) {
+		t.Fatalf("expected %v and %v to be themed the same", fg, bg)
+	}
+
+	white := color{0xff, 0xff, 0xff}
+	for _, cmd := range []DrawCharCmd{{'#', pos, white, white}, {'.', pos, fg, bg}} {
+		if err := cmd.execute(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second character's background has to cover the first, even though it's now the same as its foreground.
+	bgPos, bgSize := renderer.font.background(pos)
+	for y := bgPos.y; y < bgPos.y+bgSize.height; y++ {
+		for x := bgPos.x; x < bgPos.x+bgSize.width; x++ {
+			if c := backend.frame.RGBAAt(int(x), int(y)); c.R != 0x55 || c.G != 0x55 || c.B != 0x55 {
+				t.Fatalf("pixel %d,%d is %v; want 555555", x, y, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/lzw"
+	"encoding/binary"
+	"fmt"
+	"image"
+	imagecolor "image/color"
+	"image/color/palette"
+	"image/draw"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// videoEncoder writes a sequence of frames to a video.
+type videoEncoder interface {
+	// writeFrame adds frame to the video, to be shown at offset from the start.
+	writeFrame(frame *image.RGBA, offset time.Duration) error
+
+	// Close finishes the video.
+	Close() error
+}
+
+type videoFrame struct {
+	at    time.Time
+	frame *image.RGBA
+}
+
+// videoRecorder records every frame rendered to a video.
+//
+// Frames are handed off to a goroutine to encode so recording doesn't hold up processing commands; if the encoder
+// falls behind, frames are dropped.
+type videoRecorder struct {
+	logger  *log.Logger
+	encoder videoEncoder
+	start   time.Time
+
+	mu      sync.Mutex
+	closed  bool
+	frames  chan videoFrame
+	done    chan error
+	dropped int
+}
+
+// newVideoRecorder starts recording to path.
+//
+// Paths ending in .gif are recorded as an animated GIF; anything else gets a raw frame dump plus an index.
+func newVideoRecorder(logger *log.Logger, path string) (*videoRecorder, error) {
+	var (
+		encoder videoEncoder
+		err     error
+	)
+
+	if strings.EqualFold(filepath.Ext(path), ".gif") {
+		encoder, err = newGIFEncoder(path)
+	} else {
+		encoder, err = newRawVideoEncoder(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := videoRecorder{
+		logger:  logger,
+		encoder: encoder,
+		start:   time.Now(),
+		frames:  make(chan videoFrame, 32),
+		done:    make(chan error, 1),
+	}
+
+	go r.run()
+
+	return &r, nil
+}
+
+// record hands frame off to be encoded.
+func (r *videoRecorder) record(at time.Time, frame *image.RGBA) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	select {
+	case r.frames <- videoFrame{at, frame}:
+	default:
+		r.dropped++
+	}
+}
+
+func (r *videoRecorder) run() {
+	var (
+		err    error
+		bounds image.Rectangle
+	)
+
+	for frame := range r.frames {
+		if err != nil {
+			continue
+		}
+
+		// Videos can't change size part way through, so the first frame decides.
+		if bounds.Empty() {
+			bounds = frame.frame.Bounds()
+		} else if frame.frame.Bounds() != bounds {
+			r.logger.Printf("screen resized to %dx%d; recording stopped\n", frame.frame.Bounds().Dx(), frame.frame.Bounds().Dy())
+			err = errors.New("screen resized")
+			continue
+		}
+
+		if err = r.encoder.writeFrame(frame.frame, frame.at.Sub(r.start)); err != nil {
+			r.logger.Printf("error recording video; recording stopped: %s\n", err)
+		}
+	}
+
+	if closeErr := r.encoder.Close(); err == nil {
+		err = closeErr
+	}
+
+	r.done <- err
+}
+
+// Close stops recording and waits for the video to be finished.
+func (r *videoRecorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+
+	r.closed = true
+	close(r.frames)
+
+	if r.dropped > 0 {
+		r.logger.Printf("dropped %d frames while recording video\n", r.dropped)
+	}
+	r.mu.Unlock()
+
+	return <-r.done
+}
+
+// gifMinFrameDelay is the shortest delay most GIF viewers respect; frames that come in quicker than this are
+// merged into the next one.
+const gifMinFrameDelay = 20 * time.Millisecond
+
+// gifEncoder streams frames to an animated GIF.
+//
+// The stdlib's encoder needs every frame up front, which doesn't work for recording a whole set, so this writes the
+// file a frame at a time. Only the part of each frame that changed is encoded, and frames identical to the last one
+// just extend its delay.
+type gifEncoder struct {
+	file *os.File
+	w    *bufio.Writer
+
+	// prev is the last frame written to the file, pending is the frame waiting on the next one to find out its
+	// delay, and pendingAt is when pending is shown.
+	prev      *image.RGBA
+	pending   *image.RGBA
+	pendingAt time.Duration
+	started   bool
+
+	lzwBuf bytes.Buffer
+}
+
+func newGIFEncoder(path string) (*gifEncoder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating gif")
+	}
+
+	return &gifEncoder{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+func (e *gifEncoder) writeFrame(frame *image.RGBA, offset time.Duration) error {
+	if e.pending == nil {
+		e.pending, e.pendingAt = frame, offset
+		return nil
+	}
+
+	// Identical frames just keep the pending one up for longer.
+	if bytes.Equal(frame.Pix, e.pending.Pix) {
+		return nil
+	}
+
+	if offset-e.pendingAt < gifMinFrameDelay {
+		e.pending = frame
+		return nil
+	}
+
+	if err := e.writePending(offset - e.pendingAt); err != nil {
+		return err
+	}
+
+	e.pending, e.pendingAt = frame, offset
+
+	return nil
+}
+
+func (e *gifEncoder) writeHeader(bounds image.Rectangle) error {
+	var header []byte
+	header = append(header, "GIF89a"...)
+
+	// Logical screen descriptor: no global color table.
+	header = binary.LittleEndian.AppendUint16(header, uint16(bounds.Dx()))
+	header = binary.LittleEndian.AppendUint16(header, uint16(bounds.Dy()))
+	header = append(header, 0x00, 0x00, 0x00)
+
+	// Loop forever.
+	header = append(header, 0x21, 0xff, 0x0b)
+	header = append(header, "NETSCAPE2.0"...)
+	header = append(header, 0x03, 0x01, 0x00, 0x00, 0x00)
+
+	_, err := e.w.Write(header)
+	return err
+}
+
+// writePending writes the pending frame to the file, shown for delay.
+func (e *gifEncoder) writePending(delay time.Duration) error {
+	bounds := e.pending.Bounds()
+
+	if !e.started {
+		if err := e.writeHeader(bounds); err != nil {
+			return errors.Wrap(err, "error writing gif header")
+		}
+
+		e.started = true
+	}
+
+	changed := bounds
+	if e.prev != nil {
+		changed = changedBounds(e.prev, e.pending)
+		if changed.Empty() {
+			// Nothing to draw, but the previous frame still needs to stay up for this long; a single unchanged
+			// pixel does the job.
+			changed = image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Min.X+1, bounds.Min.Y+1)
+		}
+	}
+
+	var (
+		paletted = quantize(e.pending, changed)
+		buf      []byte
+	)
+
+	// Graphic control extension: leave the frame in place when it's done so the next one can draw over it.
+	buf = append(buf, 0x21, 0xf9, 0x04, 0x01<<2)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(delay/(10*time.Millisecond)))
+	buf = append(buf, 0x00, 0x00)
+
+	// Image descriptor with a local color table.
+	tableBits := 1
+	for 1<<tableBits < len(paletted.Palette) {
+		tableBits++
+	}
+
+	buf = append(buf, 0x2c)
+	for _, v := range []int{changed.Min.X, changed.Min.Y, changed.Dx(), changed.Dy()} {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(v))
+	}
+	buf = append(buf, 0x80|byte(tableBits-1))
+
+	for i := 0; i < 1<<tableBits; i++ {
+		var c imagecolor.RGBA
+		if i < len(paletted.Palette) {
+			c = imagecolor.RGBAModel.Convert(paletted.Palette[i]).(imagecolor.RGBA)
+		}
+
+		buf = append(buf, c.R, c.G, c.B)
+	}
+
+	// Image data: LZW compressed indexes, in sub-blocks of at most 255 bytes.
+	litWidth := tableBits
+	if litWidth < 2 {
+		litWidth = 2
+	}
+
+	e.lzwBuf.Reset()
+	lzwWriter := lzw.NewWriter(&e.lzwBuf, lzw.LSB, litWidth)
+	if _, err := lzwWriter.Write(paletted.Pix); err != nil {
+		return errors.Wrap(err, "error compressing gif frame")
+	}
+	if err := lzwWriter.Close(); err != nil {
+		return errors.Wrap(err, "error compressing gif frame")
+	}
+
+	buf = append(buf, byte(litWidth))
+	for data := e.lzwBuf.Bytes(); len(data) > 0; {
+		n := len(data)
+		if n > 255 {
+			n = 255
+		}
+
+		buf = append(buf, byte(n))
+		buf = append(buf, data[:n]...)
+		data = data[n:]
+	}
+	buf = append(buf, 0x00)
+
+	if _, err := e.w.Write(buf); err != nil {
+		return errors.Wrap(err, "error writing gif frame")
+	}
+
+	e.prev = e.pending
+
+	return nil
+}
+
+func (e *gifEncoder) Close() error {
+	defer e.file.Close()
+
+	if e.pending != nil {
+		if err := e.writePending(gifMinFrameDelay); err != nil {
+			return err
+		}
+	}
+
+	if e.started {
+		if err := e.w.WriteByte(0x3b); err != nil {
+			return errors.Wrap(err, "error writing gif trailer")
+		}
+	}
+
+	if err := e.w.Flush(); err != nil {
+		return errors.Wrap(err, "error writing gif")
+	}
+
+	return e.file.Close()
+}
+
+// changedBounds returns the smallest rectangle containing every pixel that differs between a and b.
+func changedBounds(a, b *image.RGBA) image.Rectangle {
+	var (
+		bounds  = b.Bounds()
+		changed image.Rectangle
+	)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		var (
+			rowA = a.Pix[a.PixOffset(bounds.Min.X, y):a.PixOffset(bounds.Max.X, y)]
+			rowB = b.Pix[b.PixOffset(bounds.Min.X, y):b.PixOffset(bounds.Max.X, y)]
+		)
+
+		if bytes.Equal(rowA, rowB) {
+			continue
+		}
+
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if a.RGBAAt(x, y) != b.RGBAAt(x, y) {
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+
+	return changed
+}
+
+// quantize converts the rect part of frame to a paletted image.
+//
+// The m8 only ever uses a handful of colors, so the palette is exact when it can be; otherwise it falls back to a
+// fixed palette.
+func quantize(frame *image.RGBA, rect image.Rectangle) *image.Paletted {
+	var (
+		colors = map[imagecolor.RGBA]uint8{}
+		pal    imagecolor.Palette
+	)
+
+	exact := true
+	for y := rect.Min.Y; y < rect.Max.Y && exact; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := frame.RGBAAt(x, y)
+			if _, ok := colors[c]; ok {
+				continue
+			}
+
+			if len(pal) == 256 {
+				exact = false
+				break
+			}
+
+			colors[c] = uint8(len(pal))
+			pal = append(pal, c)
+		}
+	}
+
+	if !exact {
+		paletted := image.NewPaletted(rect, palette.Plan9)
+		draw.Draw(paletted, rect, frame, rect.Min, draw.Src)
+
+		return paletted
+	}
+
+	paletted := image.NewPaletted(rect, pal)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			paletted.SetColorIndex(x, y, colors[frame.RGBAAt(x, y)])
+		}
+	}
+
+	return paletted
+}
+
+// rawVideoEncoder dumps frames as raw RGBA pixels one after another, with an index file alongside listing when each
+// frame is shown.
+//
+// Frames identical to the last one aren't written again.
+type rawVideoEncoder struct {
+	frames *os.File
+	index  *os.File
+
+	framesW *bufio.Writer
+	indexW  *bufio.Writer
+
+	prev  *image.RGBA
+	count int
+}
+
+func newRawVideoEncoder(path string) (*rawVideoEncoder, error) {
+	frames, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating video frames file")
+	}
+
+	index, err := os.Create(path + ".idx")
+	if err != nil {
+		frames.Close()
+		return nil, errors.Wrap(err, "error creating video index file")
+	}
+
+	e := rawVideoEncoder{
+		frames:  frames,
+		index:   index,
+		framesW: bufio.NewWriter(frames),
+		indexW:  bufio.NewWriter(index),
+	}
+
+	return &e, nil
+}
+
+func (e *rawVideoEncoder) writeFrame(frame *image.RGBA, offset time.Duration) error {
+	if e.prev != nil && bytes.Equal(e.prev.Pix, frame.Pix) {
+		return nil
+	}
+
+	if e.count == 0 {
+		bounds := frame.Bounds()
+		if _, err := fmt.Fprintf(e.indexW, "# %dx%d RGBA frames; frame offset_ms\n", bounds.Dx(), bounds.Dy()); err != nil {
+			return errors.Wrap(err, "error writing video index")
+		}
+	}
+
+	if _, err := e.framesW.Write(frame.Pix); err != nil {
+		return errors.Wrap(err, "error writing video frame")
+	}
+
+	if _, err := fmt.Fprintf(e.indexW, "%d %d\n", e.count, offset.Milliseconds()); err != nil {
+		return errors.Wrap(err, "error writing video index")
+	}
+
+	e.prev = frame
+	e.count++
+
+	return nil
+}
+
+func (e *rawVideoEncoder) Close() error {
+	defer e.frames.Close()
+	defer e.index.Close()
+
+	for _, w := range []*bufio.Writer{e.framesW, e.indexW} {
+		if err := w.Flush(); err != nil {
+			return errors.Wrap(err, "error writing video")
+		}
+	}
+
+	if err := e.index.Close(); err != nil {
+		return err
+	}
+
+	return e.frames.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"image"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGIFVideo(t *testing.T) {
+	var (
+		path     = filepath.Join(t.TempDir(), "session.gif")
+		backend  = newFramebufferRenderBackend()
+		renderer = newRenderer(backend)
+		ctx      = &controllerContext{renderer: renderer}
+		frames   []*image.RGBA
+	)
+
+	encoder, err := newGIFEncoder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmds := []cmd{
+		DrawRectCmd{position{0, 0}, defaultScreenSize, goldenBg},
+		DrawCharCmd{'M', position{10, 10}, goldenFg, goldenBg},
+		DrawCharCmd{'M', position{10, 10}, goldenFg, goldenBg}, // unchanged
+		DrawRectCmd{position{100, 100}, size{20, 20}, goldenRed},
+	}
+
+	for i, cmd := range cmds {
+		if err := cmd.execute(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		frame, err := backend.snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frames = append(frames, frame)
+		if err := encoder.writeFrame(frame, time.Duration(i)*100*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	decoded, err := gif.DecodeAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The unchanged frame is folded into the one before it.
+	if len(decoded.Image) != 3 {
+		t.Fatalf("expected 3 frames; got %d", len(decoded.Image))
+	}
+
+	if expected := []int{10, 20, 2}; decoded.Delay[0] != expected[0] || decoded.Delay[1] != expected[1] || decoded.Delay[2] != expected[2] {
+		t.Errorf("expected delays %v; got %v", expected, decoded.Delay)
+	}
+
+	// Composite the frames back together and check the result matches the last frame rendered.
+	composite := image.NewRGBA(frames[0].Bounds())
+	for _, frame := range decoded.Image {
+		for y := frame.Rect.Min.Y; y < frame.Rect.Max.Y; y++ {
+			for x := frame.Rect.Min.X; x < frame.Rect.Max.X; x++ {
+				composite.Set(x, y, frame.At(x, y))
+			}
+		}
+	}
+
+	if diff := changedBounds(composite, frames[len(frames)-1]); !diff.Empty() {
+		t.Errorf("expected composited gif to match last frame; differs in %v", diff)
+	}
+}
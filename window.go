@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+type windowMode int
+
+const (
+	// windowModeWindowed is a normal, resizable window.
+	windowModeWindowed windowMode = iota
+
+	// windowModeBorderless is a borderless window covering the desktop, without changing the display's mode.
+	windowModeBorderless
+
+	// windowModeFullscreen is exclusive fullscreen at the window's size.
+	windowModeFullscreen
+)
+
+func parseWindowMode(s string) (windowMode, error) {
+	switch strings.ToLower(s) {
+	case "windowed":
+		return windowModeWindowed, nil
+	case "borderless":
+		return windowModeBorderless, nil
+	case "fullscreen":
+		return windowModeFullscreen, nil
+	default:
+		return 0, errors.Errorf("unknown window mode %q (expected windowed, borderless or fullscreen)", s)
+	}
+}
+
+func (m windowMode) String() string {
+	switch m {
+	case windowModeBorderless:
+		return "borderless"
+	case windowModeFullscreen:
+		return "fullscreen"
+	default:
+		return "windowed"
+	}
+}
+
+// sdlFlags returns the SDL fullscreen flags for the mode.
+func (m windowMode) sdlFlags() uint32 {
+	switch m {
+	case windowModeBorderless:
+		return sdl.WINDOW_FULLSCREEN_DESKTOP
+	case windowModeFullscreen:
+		return sdl.WINDOW_FULLSCREEN
+	default:
+		return 0
+	}
+}
+
+type scaleMode int
+
+const (
+	// scaleModeFit scales the m8's screen as big as it'll go while keeping its aspect ratio.
+	scaleModeFit scaleMode = iota
+
+	// scaleModeInteger scales the m8's screen by the biggest whole number that fits, so every pixel is the same size.
+	scaleModeInteger
+
+	// scaleModeStretch stretches the m8's screen to fill the window.
+	scaleModeStretch
+)
+
+func parseScaleMode(s string) (scaleMode, error) {
+	switch strings.ToLower(s) {
+	case "fit":
+		return scaleModeFit, nil
+	case "integer":
+		return scaleModeInteger, nil
+	case "stretch":
+		return scaleModeStretch, nil
+	default:
+		return 0, errors.Errorf("unknown scale mode %q (expected fit, integer or stretch)", s)
+	}
+}
+
+func (m scaleMode) String() string {
+	switch m {
+	case scaleModeInteger:
+		return "integer"
+	case scaleModeStretch:
+		return "stretch"
+	default:
+		return "fit"
+	}
+}
+
+// scaleScreen returns where the m8's screen, of size screen, goes in an output of width x height.
+func scaleScreen(mode scaleMode, screen size, width, height int32) sdl.Rect {
+	var (
+		screenWidth  = int32(screen.width)
+		screenHeight = int32(screen.height)
+	)
+
+	if mode == scaleModeStretch {
+		return sdl.Rect{X: 0, Y: 0, W: width, H: height}
+	}
+
+	var w, h int32
+	if mode == scaleModeInteger {
+		scale := width / screenWidth
+		if s := height / screenHeight; s < scale {
+			scale = s
+		}
+
+		if scale < 1 {
+			scale = 1
+		}
+
+		w, h = screenWidth*scale, screenHeight*scale
+	} else {
+		scale := float64(width) / float64(screenWidth)
+		if s := float64(height) / float64(screenHeight); s < scale {
+			scale = s
+		}
+
+		w, h = int32(float64(screenWidth)*scale), int32(float64(screenHeight)*scale)
+	}
+
+	return sdl.Rect{X: (width - w) / 2, Y: (height - h) / 2, W: w, H: h}
+}
+
+type scaleFilter int
+
+const (
+	scaleFilterNearest scaleFilter = iota
+	scaleFilterLinear
+)
+
+func parseScaleFilter(s string) (scaleFilter, error) {
+	switch strings.ToLower(s) {
+	case "nearest":
+		return scaleFilterNearest, nil
+	case "linear":
+		return scaleFilterLinear, nil
+	default:
+		return 0, errors.Errorf("unknown filter %q (expected nearest or linear)", s)
+	}
+}
+
+func (f scaleFilter) String() string {
+	if f == scaleFilterLinear {
+		return "linear"
+	}
+
+	return "nearest"
+}
+
+// windowGeometry is the position and size of a window.
+type windowGeometry struct {
+	X      int32 `json:"x"`
+	Y      int32 `json:"y"`
+	Width  int32 `json:"width"`
+	Height int32 `json:"height"`
+}
+
+// windowStatePath returns where the window's geometry is remembered between runs.
+func windowStatePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "error finding config dir")
+	}
+
+	return filepath.Join(dir, "m8client", "window.json"), nil
+}
+
+// loadWindowGeometry returns the geometry the window had when the client last exited, if any.
+func loadWindowGeometry() (windowGeometry, bool) {
+	path, err := windowStatePath()
+	if err != nil {
+		return windowGeometry{}, false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return windowGeometry{}, false
+	}
+
+	var geometry windowGeometry
+	if err := json.Unmarshal(data, &geometry); err != nil || geometry.Width <= 0 || geometry.Height <= 0 {
+		return windowGeometry{}, false
+	}
+
+	return geometry, true
+}
+
+func saveWindowGeometry(geometry windowGeometry) error {
+	path, err := windowStatePath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return errors.Wrap(err, "error creating config dir")
+	}
+
+	data, err := json.Marshal(geometry)
+	if err != nil {
+		return errors.Wrap(err, "error encoding window geometry")
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return errors.Wrap(err, "error saving window geometry")
+	}
+
+	return nil
+}